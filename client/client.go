@@ -1,10 +1,12 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"sync"
 
 	"github.com/applepi-icpc/icarus"
+	"github.com/applepi-icpc/icarus/dispatcher"
 )
 
 const (
@@ -19,6 +21,27 @@ var (
 	ErrHandleExists      = errors.New("Handle exists")
 )
 
+// Dispatcher runs subtasks for users and courses, usually a `*server.Dispatcher`.
+// Users and courses keep the dispatcher they are made with, so that several
+// dispatchers could coexist in one process.
+type Dispatcher interface {
+	RunSubtaskContext(ctx context.Context, s *dispatcher.Subtask) *dispatcher.SubtaskResult
+}
+
+// Errors of a dispatcher that refuses subtasks of a handler for a while, e.g. the handler
+// is paused or its breaker is open. Tasks should wait longer and try again, rather than
+// count them as failures.
+type BackOffError interface {
+	error
+	BackOff() bool
+}
+
+// Whether err asks the caller to back off, see `BackOffError`.
+func IsBackOff(err error) bool {
+	e, ok := err.(BackOffError)
+	return ok && e.BackOff()
+}
+
 // Client is in icarus (server part).
 //
 // Server part invokes dispatcher to send task,
@@ -27,8 +50,9 @@ var (
 // and the satellite part do the actual work.
 type Client interface {
 	// Factory functions of actual (not abstract) users and courses.
-	MakeUser(userID string, password string) (icarus.User, error)
-	MakeCourse(name string, desc string, token string) (icarus.Course, error)
+	// Their subtasks go to d.
+	MakeUser(d Dispatcher, userID string, password string) (icarus.User, error)
+	MakeCourse(d Dispatcher, name string, desc string, token string) (icarus.Course, error)
 }
 
 var clientIniter sync.Once
@@ -39,12 +63,12 @@ func initInterface() {
 	})
 }
 
-func MakeUserByData(c Client, data icarus.UserData) (icarus.User, error) {
-	return c.MakeUser(data.UserID, data.Password)
+func MakeUserByData(c Client, d Dispatcher, data icarus.UserData) (icarus.User, error) {
+	return c.MakeUser(d, data.UserID, data.Password)
 }
 
-func MakeCourceByData(c Client, data icarus.CourseData) (icarus.Course, error) {
-	return c.MakeCourse(data.Name, data.Desc, data.Token)
+func MakeCourceByData(c Client, d Dispatcher, data icarus.CourseData) (icarus.Course, error) {
+	return c.MakeCourse(d, data.Name, data.Desc, data.Token)
 }
 
 func RegisterHandle(handle string, cli Client) error {
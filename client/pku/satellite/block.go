@@ -0,0 +1,29 @@
+package pku
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrBlocked = errors.New("blocked by the school system")
+)
+
+// Whole sentences on pages the school shows instead, when it throttles or bans a client.
+// Shorter ones, e.g. "您的IP", show up on ordinary pages too.
+var BlockedMarkers = []string{
+	"您的IP访问过于频繁",
+	"请勿使用刷课软件",
+	"您的IP已被封禁",
+}
+
+// Whether a response body is a ban page rather than the page asked for.
+// Status codes are not enough, as a 403 or 429 may come without a ban.
+func IsBlocked(body string) bool {
+	for _, v := range BlockedMarkers {
+		if strings.Contains(body, v) {
+			return true
+		}
+	}
+	return false
+}
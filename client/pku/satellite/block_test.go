@@ -0,0 +1,22 @@
+package pku_test
+
+import (
+	"testing"
+
+	"github.com/applepi-icpc/icarus/client/pku/satellite"
+)
+
+func TestBlocked(t *testing.T) {
+	if !pku.IsBlocked("<html>您的IP访问过于频繁，请稍后再试</html>") {
+		t.Fatalf("Ban page is not taken as blocked")
+	}
+	if pku.IsBlocked("") {
+		t.Fatalf("Empty page, e.g. of a 403, is taken as blocked")
+	}
+	if pku.IsBlocked(`{"electedNum":"17"}`) {
+		t.Fatalf("Refresh result is taken as blocked")
+	}
+	if pku.IsBlocked("<html><td>您的IP：162.105.129.1</td><td>上次登录：2016-09-01</td></html>") {
+		t.Fatalf("Ordinary page showing the IP is taken as blocked")
+	}
+}
@@ -5,6 +5,7 @@ package pku
 // #include "nzkcaptcha.h"
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
 	"image"
@@ -14,7 +15,12 @@ import (
 	"strings"
 	"unsafe"
 
-	log "github.com/Sirupsen/logrus"
+	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/trace"
+)
+
+var (
+	ErrSessionExpired = errors.New("session expired")
 )
 
 func Identify(im image.Image) string {
@@ -38,23 +44,27 @@ func Identify(im image.Image) string {
 	return C.GoString(ptr)
 }
 
-func FetchAndIdentify(jsessionid string) error {
+// Retries until the captcha is passed, or ctx is done.
+func FetchAndIdentify(ctx context.Context, jsessionid string) error {
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		req, err := http.NewRequest("GET", fmt.Sprintf("%s/elective2008/DrawServlet", electRoot), strings.NewReader(""))
 		if err != nil {
 			panic(err)
 		}
 		req.Header.Set("Cookie", fmt.Sprintf("JSESSIONID=%s", jsessionid))
-		client := &http.Client{}
-		res, err := client.Do(req)
+		httpClient := client.HTTPClient(ctx)
+		res, err := httpClient.Do(req.WithContext(ctx))
 		if err != nil {
-			log.Warnf("Client PKU: Failed to fetch captcha: %s", err.Error())
+			trace.Logger(ctx).Warnf("Client PKU: Failed to fetch captcha: %s", err.Error())
 			continue
 		}
 		defer res.Body.Close()
 		im, _, err := image.Decode(res.Body)
 		if err != nil {
-			log.Warnf("Client PKU: Failed to decode captcha image: %s", err.Error())
+			trace.Logger(ctx).Warnf("Client PKU: Failed to decode captcha image: %s", err.Error())
 			continue
 		}
 		s := Identify(im)
@@ -73,20 +83,20 @@ func FetchAndIdentify(jsessionid string) error {
 		req.Header.Set("Accept-Encoding", "gzip, deflate, sdch")
 		req.Header.Set("Accept-Language", "zh-CN,zh;q=0.8,en;q=0.6,ja;q=0.4,zh-TW;q=0.2")
 		req.Header.Set("Cookie", fmt.Sprintf("JSESSIONID=%s", jsessionid))
-		res, err = client.Do(req)
+		res, err = httpClient.Do(req.WithContext(ctx))
 		if err != nil {
-			log.Warnf("Client PKU: Failed to submit captcha result: %s", err.Error())
+			trace.Logger(ctx).Warnf("Client PKU: Failed to submit captcha result: %s", err.Error())
 			continue
 		}
 		defer res.Body.Close()
 		rawResBody, err := ioutil.ReadAll(res.Body)
 		if err != nil {
-			log.Warnf("Client PKU: Failed to read captcha submission result: %s", err.Error())
+			trace.Logger(ctx).Warnf("Client PKU: Failed to read captcha submission result: %s", err.Error())
 			continue
 		}
 		resBody := string(rawResBody)
         if strings.Index(resBody, "\"title\":") != -1 {
-			return errors.New("session expired")
+			return ErrSessionExpired
         } else if strings.Index(resBody, "{\"valid\":\"2\"}") != -1 {
 			return nil
 		}
@@ -25,3 +25,15 @@ func TestCaptcha(t *testing.T) {
 		t.Fatalf("wrong answer")
 	}
 }
+
+func TestCheckCaptcha(t *testing.T) {
+	if err := pku.CheckCaptcha("testdata"); err != nil {
+		t.Fatalf("Error checking captcha: %s", err.Error())
+	}
+	if err := pku.CheckCaptcha(""); err != nil {
+		t.Fatalf("Error checking bundled captcha: %s", err.Error())
+	}
+	if err := pku.CheckCaptcha("nowhere"); err == nil {
+		t.Fatalf("Captcha passes without samples")
+	}
+}
@@ -1,9 +1,12 @@
 package pku
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/applepi-icpc/icarus"
 	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/dispatcher"
 )
 
 const (
@@ -11,79 +14,141 @@ const (
 	electRoot = "http://elective.pku.edu.cn"
 )
 
+// Error codes reported by PKUWorker.
+const (
+	CodeLoginFailed = "login_failed"
+	CodeBadToken    = "bad_token"
+	CodeBlocked     = "blocked"
+)
+
+// Ban pages are reported as `dispatcher.StatusBlocked`, so that the satellite is quarantined.
+func blockedError() error {
+	return client.NewWorkerError(dispatcher.StatusBlocked, CodeBlocked, ErrBlocked.Error())
+}
+
 type PKUWorker struct{}
 
-func (p PKUWorker) Login(data []string) []string {
-	jsid, _, err := LoginHelper(data)
+// Version 1: typed results.
+func (p PKUWorker) Version() int {
+	return 1
+}
+
+func (p PKUWorker) Operations() map[dispatcher.SubtaskType]client.Operation {
+	return client.StandardOperations(p)
+}
+
+func (p PKUWorker) Login(ctx context.Context, req *client.LoginRequest) (*client.LoginResult, error) {
+	ctx, release, err := client.Egress(ctx, req.UserID)
 	if err != nil {
-		return []string{"failed", err.Error()}
-	} else {
-		return []string{"succeeded", jsid}
+		return nil, err
 	}
+	defer release()
+
+	jsid, _, err := LoginHelper(ctx, []string{req.UserID, req.Password})
+	if err == ErrBlocked {
+		return nil, blockedError()
+	} else if err != nil {
+		return nil, client.NewWorkerError(dispatcher.StatusRejected, CodeLoginFailed, err.Error())
+	}
+	// Elects with the session leave from where it was made.
+	client.StickTo(ctx, jsid)
+	return &client.LoginResult{
+		Session: jsid,
+	}, nil
 }
 
-func (p PKUWorker) ListCourse(data []string) []string {
-	jsid, s, err := LoginHelper(data)
+func (p PKUWorker) ListCourse(ctx context.Context, req *client.ListRequest) (*client.ListResult, error) {
+	ctx, release, err := client.Egress(ctx, req.UserID)
 	if err != nil {
-		return []string{err.Error()}
+		return nil, err
+	}
+	defer release()
+
+	jsid, s, err := LoginHelper(ctx, []string{req.UserID, req.Password})
+	if err == ErrBlocked {
+		return nil, blockedError()
+	} else if err != nil {
+		return nil, client.NewWorkerError(dispatcher.StatusRejected, CodeLoginFailed, err.Error())
 	}
 	res, err := parseList(s)
 	if err != nil {
-		return []string{err.Error()}
+		return nil, err
 	}
 	tot, err := parseTotalPage(s)
 	if err != nil {
-		return []string{err.Error()}
+		return nil, err
 	}
 	for i := 1; i < tot; i++ {
-		s, err := getOriginalPage(i, jsid)
-		if err != nil {
-			return []string{err.Error()}
+		s, err := getOriginalPage(ctx, i, jsid)
+		if err == ErrBlocked {
+			return nil, blockedError()
+		} else if err != nil {
+			return nil, err
 		}
 		resCont, err := parseList(s)
 		if err != nil {
-			return []string{err.Error()}
+			return nil, err
 		}
 		res = append(res, resCont...)
 	}
 
-	ret := []string{"succeeded"}
-	ret = append(ret, fmt.Sprintf("%d", len(res)))
+	courses := make([]icarus.CourseData, 0, len(res))
 	for _, v := range res {
-		ret = append(ret, v.Name)
-		ret = append(ret, fmt.Sprintf("%s 班: %s, %s", v.GroupID, v.Teacher, v.Msg))
-		ret = append(ret, EnToken(v.Index, v.Seq, v.UBound))
+		courses = append(courses, icarus.CourseData{
+			Name:  v.Name,
+			Desc:  fmt.Sprintf("%s 班: %s, %s", v.GroupID, v.Teacher, v.Msg),
+			Token: EnToken(v.Index, v.Seq, v.UBound),
+		})
 	}
-	return ret
+	return &client.ListResult{
+		Courses: courses,
+	}, nil
 }
 
-func (p PKUWorker) Elect(data []string) []string {
-	if len(data) < 2 {
-		return []string{"datum are not sufficient"}
+func (p PKUWorker) Elect(ctx context.Context, req *client.ElectRequest) (*client.ElectResult, error) {
+	index, seq, ubound, err := DeToken(req.Token)
+	if err != nil {
+		return nil, client.NewWorkerError(dispatcher.StatusInvalidRequest, CodeBadToken, err.Error())
 	}
-	token := data[0]
-	jsid := data[1]
 
-	index, seq, ubound, err := DeToken(token)
+	ctx, release, err := client.Egress(ctx, req.Session)
 	if err != nil {
-		return []string{err.Error()}
+		return nil, err
 	}
+	defer release()
 
-	electable, err := Refresh(jsid, index, seq, ubound)
-	if err != nil {
-		return []string{err.Error()}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	electable, err := Refresh(ctx, req.Session, index, seq, ubound)
+	if err == ErrBlocked {
+		return nil, blockedError()
+	} else if err != nil {
+		return nil, err
 	}
 	if electable {
-		res, err := Supplement(jsid, index, seq)
-		if err != nil {
-			return []string{err.Error()}
+		// Do not elect for a cancelled or expired subtask.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		res, err := Supplement(ctx, req.Session, index, seq)
+		if err == ErrSessionExpired {
+			return nil, client.NewWorkerError(dispatcher.StatusSessionExpired, "", err.Error())
+		} else if err == ErrBlocked {
+			return nil, blockedError()
+		} else if err != nil {
+			return nil, err
 		}
 		if res {
-			return []string{"succeeded"}
+			return &client.ElectResult{
+				Elected: true,
+			}, nil
 		}
 	}
 
-	return []string{"full"}
+	return &client.ElectResult{
+		Elected: false,
+	}, nil
 }
 
 func init() {
@@ -1,6 +1,7 @@
 package pku_test
 
 import (
+	"context"
 	"flag"
 	"os"
 	"testing"
@@ -19,14 +20,14 @@ func TestMain(m *testing.M) {
 }
 
 func TestLoginAndCaptcha(t *testing.T) {
-	jsid, _, err := pku.LoginHelper([]string{*flagUserID, *flagPassword})
+	jsid, _, err := pku.LoginHelper(context.Background(), []string{*flagUserID, *flagPassword})
 	if err != nil {
 		t.Fatalf("Login error: %s", err.Error())
 	} else {
 		t.Logf("JSESSIONID: %s", jsid)
 	}
 
-	err = pku.FetchAndIdentify(jsid)
+	err = pku.FetchAndIdentify(context.Background(), jsid)
 	if err != nil {
 		t.Fatalf("Failed to pass captcha: %s", err.Error())
 	}
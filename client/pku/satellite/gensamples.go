@@ -0,0 +1,41 @@
+//go:build ignore
+// +build ignore
+
+// Generates samples.go, which bundles the captcha samples in testdata into the binary.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+func main() {
+	paths, err := filepath.Glob("testdata/*.jpg")
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "// Code generated by gensamples.go; DO NOT EDIT.")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "package pku")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "var bundledSamples = map[string][]byte{")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(buf, "\t%q: []byte(%q),\n", filepath.Base(path), data)
+	}
+	fmt.Fprintln(buf, "}")
+
+	if err := ioutil.WriteFile("samples.go", buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package pku
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,8 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+
+	"github.com/applepi-icpc/icarus/client"
 )
 
 var (
@@ -17,8 +20,17 @@ var (
 	regexToken     = regexp.MustCompile(`"token":"(\w+)"`)
 )
 
+// Same as http.Get, but aborted once ctx is done.
+func getContext(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.HTTPClient(ctx).Do(req.WithContext(ctx))
+}
+
 // Return jsessionid, supplement page, error
-func LoginHelper(data []string) (string, string, error) {
+func LoginHelper(ctx context.Context, data []string) (string, string, error) {
 	if len(data) < 2 {
 		return "", "", errors.New("datum are not sufficient")
 	}
@@ -26,7 +38,7 @@ func LoginHelper(data []string) (string, string, error) {
 	password := data[1]
 
 	// Step 1: Get IAAA Session
-	res, err := http.Get(fmt.Sprintf("%s/iaaa/oauth.jsp?appID=syllabus&appName=学生选课系统&redirectUrl=http://elective.pku.edu.cn:80/elective2008/agent4Iaaa.jsp/../ssoLogin.do", iaaaRoot))
+	res, err := getContext(ctx, fmt.Sprintf("%s/iaaa/oauth.jsp?appID=syllabus&appName=学生选课系统&redirectUrl=http://elective.pku.edu.cn:80/elective2008/agent4Iaaa.jsp/../ssoLogin.do", iaaaRoot))
 	if err != nil {
 		return "", "", errors.New(fmt.Sprintf("failed on step 1 (get iaaa session) #1: %s", err.Error()))
 	}
@@ -55,8 +67,8 @@ func LoginHelper(data []string) (string, string, error) {
 	req.Header.Set("Cookie", fmt.Sprintf("JSESSIONID=%s", jsessionid))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	client := &http.Client{}
-	res, err = client.Do(req)
+	httpClient := client.HTTPClient(ctx)
+	res, err = httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return "", "", errors.New(fmt.Sprintf("failed on step 2 (get iaaa token) #1: %s", err.Error()))
 	}
@@ -82,7 +94,7 @@ func LoginHelper(data []string) (string, string, error) {
 
 	// Step 3: Get Elective Session
 	randS := fmt.Sprintf("%.15f", rand.Float64())
-	res, err = http.Get(fmt.Sprintf("%s/elective2008/ssoLogin.do?rand=%s&token=%s", electRoot, randS, token))
+	res, err = getContext(ctx, fmt.Sprintf("%s/elective2008/ssoLogin.do?rand=%s&token=%s", electRoot, randS, token))
 	if err != nil {
 		return "", "", errors.New(fmt.Sprintf("failed on step 3 (get elective session) #1: %s", err.Error()))
 	}
@@ -113,7 +125,7 @@ func LoginHelper(data []string) (string, string, error) {
 	req.Header.Set("Accept-Encoding", "gzip, deflate, sdch")
 	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.8,en;q=0.6,ja;q=0.4,zh-TW;q=0.2")
 	req.Header.Set("Cookie", fmt.Sprintf("JSESSIONID=%s", jsessionid))
-	res, err = client.Do(req)
+	res, err = httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return "", "", errors.New(fmt.Sprintf("failed on step 4 (activate) #1: %s", err.Error()))
 	}
@@ -121,6 +133,8 @@ func LoginHelper(data []string) (string, string, error) {
 	s, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return jsessionid, "", nil
+	} else if IsBlocked(string(s)) {
+		return "", "", ErrBlocked
 	} else {
 		return jsessionid, string(s), nil
 	}
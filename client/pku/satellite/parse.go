@@ -1,6 +1,7 @@
 package pku
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +9,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/applepi-icpc/icarus/client"
 )
 
 var (
@@ -134,7 +137,7 @@ func parseList(s string) (res []PKUClass, err error) {
 	return
 }
 
-func getOriginalPage(pagenum int, jsessionid string) (string, error) {
+func getOriginalPage(ctx context.Context, pagenum int, jsessionid string) (string, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/elective2008/edu/pku/stu/elective/controller/supplement/supplement.jsp?netui_pagesize=electableListGrid%%3B20&netui_row=electableListGrid%%3B%d", electRoot, pagenum*20), strings.NewReader(""))
 	if err != nil {
 		panic(err)
@@ -149,8 +152,8 @@ func getOriginalPage(pagenum int, jsessionid string) (string, error) {
 	req.Header.Set("Accept-Encoding", "gzip, deflate, sdch")
 	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.8,en;q=0.6,ja;q=0.4,zh-TW;q=0.2")
 	req.Header.Set("Cookie", fmt.Sprintf("JSESSIONID=%s", jsessionid))
-	client := &http.Client{}
-	res, err := client.Do(req)
+	httpClient := client.HTTPClient(ctx)
+	res, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return "", errors.New(fmt.Sprintf("error requesting supplement page: %s", err.Error()))
 	}
@@ -159,5 +162,8 @@ func getOriginalPage(pagenum int, jsessionid string) (string, error) {
 	if err != nil {
 		return "", errors.New(fmt.Sprintf("error reading supplement page: %s", err.Error()))
 	}
+	if IsBlocked(string(rawResBody)) {
+		return "", ErrBlocked
+	}
 	return string(rawResBody), nil
 }
@@ -0,0 +1,91 @@
+package pku
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	"github.com/applepi-icpc/icarus/client"
+)
+
+//go:generate go run gensamples.go
+
+var (
+	flagCaptchaSamples = flag.String("captcha-samples", "", "Directory of captcha samples checked by -selftest (default: samples bundled in the binary)")
+
+	// Answers of the captcha samples, by file name.
+	CaptchaSamples = map[string]string{
+		"test.jpg": "5JFU",
+	}
+)
+
+func init() {
+	client.RegisterCheck("pku captcha", func(ctx context.Context) error {
+		return CheckCaptcha(*flagCaptchaSamples)
+	})
+}
+
+// Whether the captcha recognizer passes on the samples in dir, or on the bundled samples if dir is empty.
+func CheckCaptcha(dir string) error {
+	names := make([]string, 0, len(CaptchaSamples))
+	for k := range CaptchaSamples {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data, ok := bundledSamples[name]
+		if dir != "" {
+			var err error
+			if data, err = ioutil.ReadFile(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		} else if !ok {
+			return fmt.Errorf("%s: sample not bundled", name)
+		}
+		im, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+		if s := Identify(im); s != CaptchaSamples[name] {
+			return fmt.Errorf("%s identified as %q rather than %q", name, s, CaptchaSamples[name])
+		}
+	}
+	return nil
+}
+
+// The elective system is reachable through the egress proxies, and does not block this satellite.
+func (p PKUWorker) Probe(ctx context.Context) error {
+	ctx, release, err := client.Egress(ctx, "probe")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/elective2008/", electRoot), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.HTTPClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if IsBlocked(string(body)) {
+		return ErrBlocked
+	}
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("elective system: HTTP %d", res.StatusCode)
+	}
+	return nil
+}
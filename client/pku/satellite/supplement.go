@@ -1,6 +1,7 @@
 package pku
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,7 +10,8 @@ import (
 	"strconv"
 	"strings"
 
-	log "github.com/Sirupsen/logrus"
+	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/trace"
 )
 
 var (
@@ -17,7 +19,7 @@ var (
 	reSupError   = regexp.MustCompile(`<label class='message_error'>(.*?)</label>`)
 )
 
-func Refresh(jsessionid string, index string, seq string, ubound int) (bool, error) {
+func Refresh(ctx context.Context, jsessionid string, index string, seq string, ubound int) (bool, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/elective2008/edu/pku/stu/elective/controller/supplement/refreshLimit.do?index=%s&seq=%s", electRoot, index, seq), strings.NewReader(""))
 	if err != nil {
 		panic(err)
@@ -32,19 +34,23 @@ func Refresh(jsessionid string, index string, seq string, ubound int) (bool, err
 	req.Header.Set("Accept-Encoding", "gzip, deflate, sdch")
 	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.8,en;q=0.6,ja;q=0.4,zh-TW;q=0.2")
 	req.Header.Set("Cookie", fmt.Sprintf("JSESSIONID=%s", jsessionid))
-	client := &http.Client{}
-	res, err := client.Do(req)
+	httpClient := client.HTTPClient(ctx)
+	res, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		log.Warnf("Client PKU: Failed to refresh: %s", err.Error())
+		trace.Logger(ctx).Warnf("Client PKU: Failed to refresh: %s", err.Error())
 		return false, err
 	}
 	defer res.Body.Close()
 	rawResBody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Warnf("Client PKU: Failed to read refresh result: %s", err.Error())
+		trace.Logger(ctx).Warnf("Client PKU: Failed to read refresh result: %s", err.Error())
 		return false, err
 	}
 	resBody := string(rawResBody)
+	if IsBlocked(resBody) {
+		trace.Logger(ctx).Warnf("Client PKU: Failed to refresh: %s", ErrBlocked.Error())
+		return false, ErrBlocked
+	}
 	match := reElectedNum.FindStringSubmatch(resBody)
 	var elected int
 	if match == nil {
@@ -53,7 +59,7 @@ func Refresh(jsessionid string, index string, seq string, ubound int) (bool, err
 		elected, err = strconv.Atoi(match[1])
 	}
 	if err != nil {
-		log.Warnf("Client PKU: %s", err.Error())
+		trace.Logger(ctx).Warnf("Client PKU: %s", err.Error())
 		return false, err
 	}
 
@@ -64,8 +70,8 @@ func Refresh(jsessionid string, index string, seq string, ubound int) (bool, err
 	}
 }
 
-func Supplement(jsessionid string, index string, seq string) (bool, error) {
-	err := FetchAndIdentify(jsessionid)
+func Supplement(ctx context.Context, jsessionid string, index string, seq string) (bool, error) {
+	err := FetchAndIdentify(ctx, jsessionid)
 	if err != nil {
 		return false, err
 	}
@@ -84,20 +90,24 @@ func Supplement(jsessionid string, index string, seq string) (bool, error) {
 	req.Header.Set("Accept-Encoding", "gzip, deflate, sdch")
 	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.8,en;q=0.6,ja;q=0.4,zh-TW;q=0.2")
 	req.Header.Set("Cookie", fmt.Sprintf("JSESSIONID=%s", jsessionid))
-	client := &http.Client{}
-	res, err := client.Do(req)
+	httpClient := client.HTTPClient(ctx)
+	res, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		log.Warnf("Client PKU: Failed to supplement: %s", err.Error())
+		trace.Logger(ctx).Warnf("Client PKU: Failed to supplement: %s", err.Error())
 		return false, err
 	}
 	defer res.Body.Close()
 	rawResBody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Warnf("Client PKU: Failed to read supplement result: %s", err.Error())
+		trace.Logger(ctx).Warnf("Client PKU: Failed to read supplement result: %s", err.Error())
 		return false, err
 	}
 	resBody := string(rawResBody)
     fmt.Println(resBody)
+	if IsBlocked(resBody) {
+		trace.Logger(ctx).Warnf("Client PKU: Failed to supplement: %s", ErrBlocked.Error())
+		return false, ErrBlocked
+	}
 	if strings.Index(resBody, "success.gif") != -1 {
 		// めでたしめでたし
 		return true, nil
@@ -108,7 +118,7 @@ func Supplement(jsessionid string, index string, seq string) (bool, error) {
 		} else {
 			err = errors.New(match[1])
 		}
-		log.Warnf("Client PKU: Failed to supplement: Server response: %s", err.Error())
+		trace.Logger(ctx).Warnf("Client PKU: Failed to supplement: Server response: %s", err.Error())
 		return false, err
 	}
 }
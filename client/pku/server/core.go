@@ -1,173 +1,248 @@
 package pku
 
 import (
+	"context"
 	"errors"
-	"strconv"
+	"flag"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+
 	"github.com/applepi-icpc/icarus"
 	"github.com/applepi-icpc/icarus/client"
 	"github.com/applepi-icpc/icarus/dispatcher"
 	"github.com/applepi-icpc/icarus/dispatcher/server"
 	"github.com/applepi-icpc/icarus/task"
+	"github.com/applepi-icpc/icarus/trace"
+)
+
+var (
+	flagSelector = flag.String("pku-selector", "", "Label selector of PKU subtasks, e.g. network=campus")
+
+	selectorOnce sync.Once
+	selector     dispatcher.Labels
 )
 
+// Some operations only work from campus IPs, so PKU subtasks could be restricted
+// to satellites with some labels.
+func getSelector() dispatcher.Labels {
+	selectorOnce.Do(func() {
+		var err error
+		selector, err = dispatcher.ParseLabels(*flagSelector)
+		if err != nil {
+			log.Fatalf("Client PKU: Invalid selector %q: %s", *flagSelector, err.Error())
+		}
+	})
+	return selector
+}
+
 type PKUClient struct{}
 
 type PKUUser struct {
+	disp     client.Dispatcher
 	userID   string
 	password string
 }
 
 type PKUCourse struct {
+	disp  client.Dispatcher
 	name  string
 	desc  string
 	token string
 }
 
-type PKULoginSession string
+// Elect subtasks run with the session on the satellite that logged in, so the user ID goes along.
+type PKULoginSession struct {
+	UserID     string
+	JSessionID string
+}
+
+// Make a subtask carrying both the typed request and its legacy positional form,
+// so that satellites with legacy workers could still handle it.
+func newSubtask(ctx context.Context, userID string, tp dispatcher.SubtaskType, req interface{}, legacy []string) *dispatcher.Subtask {
+	sb := &dispatcher.Subtask{
+		Handler:  "pku",
+		Type:     tp,
+		Data:     legacy,
+		Affinity: dispatcher.AffinityKey("pku", userID),
+		Selector: getSelector(),
+		Tags:     dispatcher.TagsFromContext(ctx),
+		Trace:    trace.FromContext(ctx).Context(),
+	}
+	if err := sb.SetPayload(req); err != nil {
+		// Requests are plain structs.
+		panic(err)
+	}
+	return sb
+}
+
+// Legacy form of login and list subtasks. Nil if the password is sealed, since legacy
+// workers could not unseal it, and the ciphertext has no business in Data.
+func (pu PKUUser) legacyData() []string {
+	if dispatcher.IsSealed(pu.password) {
+		return nil
+	}
+	return []string{pu.userID, pu.password}
+}
+
+// Subtasks carrying a sealed password only go to satellites holding its worker key.
+func withPassword(sb *dispatcher.Subtask, password string) *dispatcher.Subtask {
+	sb.Selector = dispatcher.MergeLabels(sb.Selector, client.SealedSelector(password))
+	return sb
+}
+
+// Error of a typed result whose status is not OK.
+func resultError(res *dispatcher.SubtaskResult) error {
+	if res.Status == dispatcher.StatusSessionExpired {
+		return task.ErrSessionExpired
+	}
+	if res.Message == "" {
+		return errors.New(res.Status.String())
+	}
+	return errors.New(res.Message)
+}
 
 func (pu PKUUser) Name() string {
 	return pu.userID
 }
 
-func (pu PKUUser) Login() (icarus.LoginSession, error) {
-	res := server.DefaultDispatcher.RunSubtask(&dispatcher.Subtask{
-		Handler: "pku",
-		Type:    dispatcher.SubtaskLogin,
-		Data:    []string{pu.userID, pu.password},
-	})
+func (pu PKUUser) Login(ctx context.Context) (icarus.LoginSession, error) {
+	log := trace.Logger(ctx)
+	res := pu.disp.RunSubtaskContext(ctx, withPassword(newSubtask(ctx, pu.userID, dispatcher.SubtaskLogin,
+		&client.LoginRequest{UserID: pu.userID, Password: pu.password},
+		pu.legacyData(),
+	), pu.password))
 	if res.Error != nil {
 		return nil, res.Error
-	} else {
-		// Data:
-		// + "failed" / "succeeded"
-		// + Reason / SessionID
-
-		if len(res.Data) < 2 {
-			log.Warnf("Client PKU: Invalid login data: %v", res.Data)
-			return nil, server.ErrInvalidData
-		} else if res.Data[0] == "failed" {
-			log.Warnf("Client PKU: Failed to login: %s", res.Data[1])
-			return nil, server.ErrFailedToLogin
-		} else {
-			if res.Data[0] != "succeeded" {
-				log.Warnf("Client PKU: Invalid login data: %v", res.Data)
-				return nil, server.ErrInvalidData
-			}
-			log.Infof("Client PKU: Successfully login.")
-			return PKULoginSession(res.Data[1]), nil
-		}
 	}
+	if res.Legacy() {
+		return legacyLogin(log, pu.userID, res)
+	}
+
+	switch res.Status {
+	case dispatcher.StatusOK:
+	case dispatcher.StatusRejected:
+		log.Warnf("Client PKU: Failed to login: %s", res.Message)
+		return nil, server.ErrFailedToLogin
+	default:
+		return nil, resultError(res)
+	}
+
+	var lr client.LoginResult
+	err := res.DecodePayload(&lr)
+	if err != nil {
+		log.Warnf("Client PKU: Invalid login result: %s", err.Error())
+		return nil, server.ErrInvalidData
+	}
+	log.Infof("Client PKU: Successfully login.")
+	return PKULoginSession{
+		UserID:     pu.userID,
+		JSessionID: lr.Session,
+	}, nil
 }
 
-func (pu PKUUser) ListCourse() ([]icarus.CourseData, error) {
-	res := server.DefaultDispatcher.RunSubtask(&dispatcher.Subtask{
-		Handler: "pku",
-		Type:    dispatcher.SubtaskList,
-		Data:    []string{pu.userID, pu.password},
-	})
+func (pu PKUUser) ListCourse(ctx context.Context) ([]icarus.CourseData, error) {
+	log := trace.Logger(ctx)
+	res := pu.disp.RunSubtaskContext(ctx, withPassword(newSubtask(ctx, pu.userID, dispatcher.SubtaskList,
+		&client.ListRequest{UserID: pu.userID, Password: pu.password},
+		pu.legacyData(),
+	), pu.password))
 	if res.Error != nil {
 		return nil, res.Error
-	} else {
-		// Data:
-		// + "succeeded" / error
-		// + Total amount of courses
-		// (For each course)
-		//     + Name
-		//     + Desc
-		//     + Token
-
-		if len(res.Data) < 1 {
-			log.Warnf("Client PKU (%s): Invalid course list: %v", pu.userID, res.Data)
-			return nil, server.ErrInvalidData
-		}
-		if res.Data[0] != "succeeded" {
-			return nil, errors.New(res.Data[0])
-		}
-		if len(res.Data) < 2 {
-			log.Warnf("Client PKU (%s): Invalid course list: %v", pu.userID, res.Data)
-			return nil, server.ErrInvalidData
-		}
-		count, err := strconv.Atoi(res.Data[1])
-		if err != nil {
-			log.Warnf("Client PKU (%s): Failed to parse course list count: %s (%v)", pu.userID, err.Error(), res.Data)
-			return nil, server.ErrInvalidData
-		}
-		rawData := res.Data[2:]
-		if len(rawData) < 3*count {
-			log.Warnf("Client PKU (%s): Invalid course list: %v", pu.userID, res.Data)
-			return nil, server.ErrInvalidData
-		}
-		res := make([]icarus.CourseData, count)
-		for i := 0; i < count; i++ {
-			res[i] = icarus.CourseData{
-				Name:  rawData[i*3],
-				Desc:  rawData[i*3+1],
-				Token: rawData[i*3+2],
-			}
-		}
-		return res, nil
 	}
+	if res.Legacy() {
+		return legacyListCourse(log, pu.userID, res)
+	}
+	if res.Status != dispatcher.StatusOK {
+		return nil, resultError(res)
+	}
+
+	var lr client.ListResult
+	err := res.DecodePayload(&lr)
+	if err != nil {
+		log.Warnf("Client PKU (%s): Invalid course list: %s", pu.userID, err.Error())
+		return nil, server.ErrInvalidData
+	}
+	return lr.Courses, nil
 }
 
 func (pc PKUCourse) Name() string {
 	return pc.name
 }
 
-func (pc PKUCourse) Elect(session icarus.LoginSession) (bool, error) {
+func (pc PKUCourse) Elect(ctx context.Context, session icarus.LoginSession) (bool, error) {
+	log := trace.Logger(ctx)
 	s, ok := session.(PKULoginSession)
 	if !ok {
-		log.Warnf("Client PKU (%s): Wrong session type! Session should be a JSESSIONID string.", pc.name)
+		log.Warnf("Client PKU (%s): Wrong session type! Session should be a PKULoginSession.", pc.name)
 		return false, server.ErrWrongType
 	}
 
-	res := server.DefaultDispatcher.RunSubtask(&dispatcher.Subtask{
-		Handler: "pku",
-		Type:    dispatcher.SubtaskElect,
-		Data:    []string{pc.token, string(s)},
-	})
+	res := pc.disp.RunSubtaskContext(ctx, newSubtask(ctx, s.UserID, dispatcher.SubtaskElect,
+		&client.ElectRequest{Token: pc.token, Session: s.JSessionID},
+		[]string{pc.token, s.JSessionID},
+	))
 	if res.Error != nil {
 		return false, res.Error
-	} else {
-		// Data:
-		// + "succeeded" / "full" / error
+	}
+	if res.Legacy() {
+		return legacyElect(log, pc.name, res)
+	}
+	if res.Status != dispatcher.StatusOK {
+		return false, resultError(res)
+	}
 
-		if len(res.Data) < 1 {
-			log.Warnf("Client PKU (%s): Invalid elect response: %v", pc.name, res.Data)
-			return false, server.ErrInvalidData
-		}
-		if res.Data[0] == "succeeded" {
-			log.Infof("Client PKU (%s): Elected!", pc.name)
-			return true, nil
-		} else if res.Data[0] == "full" {
-			log.Infof("Client PKU (%s): Full.", pc.name)
-			return false, nil
-		} else if res.Data[0] == "session expired" {
-			return false, task.ErrSessionExpired
-		} else {
-			return false, errors.New(res.Data[0])
-		}
+	var er client.ElectResult
+	err := res.DecodePayload(&er)
+	if err != nil {
+		log.Warnf("Client PKU (%s): Invalid elect result: %s", pc.name, err.Error())
+		return false, server.ErrInvalidData
 	}
+	if er.Elected {
+		log.Infof("Client PKU (%s): Elected!", pc.name)
+	} else {
+		log.Infof("Client PKU (%s): Full.", pc.name)
+	}
+	return er.Elected, nil
 }
 
-func (p PKUClient) MakeUser(userID string, password string) (icarus.User, error) {
+// The password could be sealed to a worker key, see `client.SealPassword`.
+func (p PKUClient) MakeUser(d client.Dispatcher, userID string, password string) (icarus.User, error) {
+	if dispatcher.IsSealed(password) {
+		if _, err := dispatcher.SealedKeyID(password); err != nil {
+			return nil, err
+		}
+	}
 	return PKUUser{
+		disp:     d,
 		userID:   userID,
 		password: password,
 	}, nil
 }
 
-func (p PKUClient) MakeCourse(name string, desc string, token string) (icarus.Course, error) {
+func (p PKUClient) MakeCourse(d client.Dispatcher, name string, desc string, token string) (icarus.Course, error) {
 	return PKUCourse{
+		disp:  d,
 		name:  name,
 		desc:  desc,
 		token: token,
 	}, nil
 }
 
+var operations = []dispatcher.Operation{
+	{Name: dispatcher.SubtaskLogin, Timeout: 10 * time.Second},
+	{Name: dispatcher.SubtaskList, Timeout: 30 * time.Second},
+	{Name: dispatcher.SubtaskElect, Timeout: 5 * time.Second},
+}
+
 func init() {
 	if err := client.RegisterHandle("pku", PKUClient{}); err != nil {
 		panic(err)
 	}
+	for _, op := range operations {
+		if err := dispatcher.RegisterOperation("pku", op); err != nil {
+			panic(err)
+		}
+	}
 }
@@ -0,0 +1,77 @@
+package pku_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/client/pku/server"
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Answers logins with its own session, and remembers the subtasks.
+type fakeDispatcher struct {
+	session  string
+	subtasks []*dispatcher.Subtask
+}
+
+func (f *fakeDispatcher) RunSubtaskContext(ctx context.Context, s *dispatcher.Subtask) *dispatcher.SubtaskResult {
+	f.subtasks = append(f.subtasks, s)
+	return dispatcher.NewResult(client.LoginResult{Session: f.session})
+}
+
+func TestDispatchers(t *testing.T) {
+	cli, err := client.GetHandle("pku")
+	if err != nil {
+		t.Fatalf("PKU handle not registered: %s", err.Error())
+	}
+
+	// Two dispatchers in one process, e.g. one per tenant.
+	a := &fakeDispatcher{session: "session-a"}
+	b := &fakeDispatcher{session: "session-b"}
+	for _, d := range []*fakeDispatcher{a, b} {
+		u, err := cli.MakeUser(d, "marisa", "alice")
+		if err != nil {
+			t.Fatalf("Error making user: %s", err.Error())
+		}
+		session, err := u.Login(context.Background())
+		if err != nil {
+			t.Fatalf("Error logging in: %s", err.Error())
+		}
+		if s := session.(pku.PKULoginSession); s.JSessionID != d.session {
+			t.Fatalf("Login went to another dispatcher: %s", s.JSessionID)
+		}
+	}
+	if len(a.subtasks) != 1 || len(b.subtasks) != 1 {
+		t.Fatalf("Subtasks went to wrong dispatchers: %d, %d", len(a.subtasks), len(b.subtasks))
+	}
+	if s := a.subtasks[0]; s.Handler != "pku" || s.Type != dispatcher.SubtaskLogin {
+		t.Fatalf("Wrong subtask: %s %s", s.Handler, s.Type)
+	}
+}
+
+func TestSealedNoLegacyData(t *testing.T) {
+	cli, err := client.GetHandle("pku")
+	if err != nil {
+		t.Fatalf("PKU handle not registered: %s", err.Error())
+	}
+
+	sealed := dispatcher.SealedPrefix + strings.Repeat("0", dispatcher.KeyIDLength) + ":wrapped:content"
+	d := &fakeDispatcher{session: "session"}
+	for _, password := range []string{"alice", sealed} {
+		u, err := cli.MakeUser(d, "marisa", password)
+		if err != nil {
+			t.Fatalf("Error making user: %s", err.Error())
+		}
+		if _, err := u.Login(context.Background()); err != nil {
+			t.Fatalf("Error logging in: %s", err.Error())
+		}
+	}
+	if s := d.subtasks[0]; len(s.Data) != 2 || s.Data[1] != "alice" {
+		t.Fatalf("Plain password not in legacy data: %v", s.Data)
+	}
+	if s := d.subtasks[1]; s.Data != nil {
+		t.Fatalf("Sealed password copied into legacy data: %v", s.Data)
+	}
+}
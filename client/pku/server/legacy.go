@@ -0,0 +1,100 @@
+package pku
+
+import (
+	"errors"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/applepi-icpc/icarus"
+	"github.com/applepi-icpc/icarus/dispatcher"
+	"github.com/applepi-icpc/icarus/dispatcher/server"
+	"github.com/applepi-icpc/icarus/task"
+)
+
+// Decoders of results from legacy satellites (protocol version 0).
+
+func legacyLogin(log *log.Entry, userID string, res *dispatcher.SubtaskResult) (icarus.LoginSession, error) {
+	// Data:
+	// + "failed" / "succeeded"
+	// + Reason / SessionID
+
+	if len(res.Data) < 2 {
+		log.Warnf("Client PKU: Invalid login data: %v", res.Data)
+		return nil, server.ErrInvalidData
+	} else if res.Data[0] == "failed" {
+		log.Warnf("Client PKU: Failed to login: %s", res.Data[1])
+		return nil, server.ErrFailedToLogin
+	} else {
+		if res.Data[0] != "succeeded" {
+			log.Warnf("Client PKU: Invalid login data: %v", res.Data)
+			return nil, server.ErrInvalidData
+		}
+		log.Infof("Client PKU: Successfully login.")
+		return PKULoginSession{
+			UserID:     userID,
+			JSessionID: res.Data[1],
+		}, nil
+	}
+}
+
+func legacyListCourse(log *log.Entry, userID string, res *dispatcher.SubtaskResult) ([]icarus.CourseData, error) {
+	// Data:
+	// + "succeeded" / error
+	// + Total amount of courses
+	// (For each course)
+	//     + Name
+	//     + Desc
+	//     + Token
+
+	if len(res.Data) < 1 {
+		log.Warnf("Client PKU (%s): Invalid course list: %v", userID, res.Data)
+		return nil, server.ErrInvalidData
+	}
+	if res.Data[0] != "succeeded" {
+		return nil, errors.New(res.Data[0])
+	}
+	if len(res.Data) < 2 {
+		log.Warnf("Client PKU (%s): Invalid course list: %v", userID, res.Data)
+		return nil, server.ErrInvalidData
+	}
+	count, err := strconv.Atoi(res.Data[1])
+	if err != nil {
+		log.Warnf("Client PKU (%s): Failed to parse course list count: %s (%v)", userID, err.Error(), res.Data)
+		return nil, server.ErrInvalidData
+	}
+	rawData := res.Data[2:]
+	if len(rawData) < 3*count {
+		log.Warnf("Client PKU (%s): Invalid course list: %v", userID, res.Data)
+		return nil, server.ErrInvalidData
+	}
+	courses := make([]icarus.CourseData, count)
+	for i := 0; i < count; i++ {
+		courses[i] = icarus.CourseData{
+			Name:  rawData[i*3],
+			Desc:  rawData[i*3+1],
+			Token: rawData[i*3+2],
+		}
+	}
+	return courses, nil
+}
+
+func legacyElect(log *log.Entry, name string, res *dispatcher.SubtaskResult) (bool, error) {
+	// Data:
+	// + "succeeded" / "full" / error
+
+	if len(res.Data) < 1 {
+		log.Warnf("Client PKU (%s): Invalid elect response: %v", name, res.Data)
+		return false, server.ErrInvalidData
+	}
+	if res.Data[0] == "succeeded" {
+		log.Infof("Client PKU (%s): Elected!", name)
+		return true, nil
+	} else if res.Data[0] == "full" {
+		log.Infof("Client PKU (%s): Full.", name)
+		return false, nil
+	} else if res.Data[0] == "session expired" {
+		return false, task.ErrSessionExpired
+	} else {
+		return false, errors.New(res.Data[0])
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/applepi-icpc/icarus"
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Typed requests and results of each subtask type.
+// They are carried as JSON in `Subtask.Payload` and `SubtaskResult.Payload`.
+
+type LoginRequest struct {
+	UserID   string `json:"userid"`
+	Password string `json:"password"`
+}
+
+// Requests carrying a password, which may be sealed. See sealed.go.
+type credentialed interface {
+	credentials() (userID string, password *string)
+}
+
+func (r *LoginRequest) credentials() (string, *string) {
+	return r.UserID, &r.Password
+}
+
+type LoginResult struct {
+	Session string `json:"session"`
+}
+
+type ListRequest struct {
+	UserID   string `json:"userid"`
+	Password string `json:"password"`
+}
+
+func (r *ListRequest) credentials() (string, *string) {
+	return r.UserID, &r.Password
+}
+
+type ListResult struct {
+	Courses []icarus.CourseData `json:"courses"`
+}
+
+type ElectRequest struct {
+	Token   string `json:"token"`
+	Session string `json:"session"`
+}
+
+type ElectResult struct {
+	// False if the course is full.
+	Elected bool `json:"elected"`
+}
+
+// WorkerError is how a worker reports a failure with a specific status.
+// `ErrNoProxy` is reported as `dispatcher.StatusUnavailable`, and any other error
+// returned by a worker as `dispatcher.StatusFailed`.
+type WorkerError struct {
+	Status  dispatcher.ResultStatus
+	Code    string
+	Message string
+}
+
+func NewWorkerError(status dispatcher.ResultStatus, code string, message string) *WorkerError {
+	return &WorkerError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *WorkerError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s: %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("%s (%s): %s", e.Status, e.Code, e.Message)
+}
+
+// Make a result from what a worker returned.
+func resultOf(v interface{}, err error) *dispatcher.SubtaskResult {
+	if err != nil {
+		if we, ok := err.(*WorkerError); ok {
+			return dispatcher.FailedResult(we.Status, we.Code, we.Message)
+		}
+		if err == ErrNoProxy {
+			// Not the school's fault, see `Egress`.
+			return dispatcher.FailedResult(dispatcher.StatusUnavailable, dispatcher.CodeNoEgress, err.Error())
+		}
+		return dispatcher.FailedResult(dispatcher.StatusFailed, "", err.Error())
+	}
+	return dispatcher.NewResult(v)
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Worker keys of handles, to which users could seal their credentials
+// (see `dispatcher.Seal`), so that the server could not read them.
+//
+// The server publishes the public halves given by `-worker-pub`, and routes subtasks
+// carrying sealed credentials to satellites labelled with the key (see `SealedSelector`).
+// Satellites holding private halves, given by `-worker-priv`, are labelled so, and
+// unseal credentials before workers get them.
+
+var (
+	flagWorkerPub  = flag.String("worker-pub", "", "Public worker keys of handles to publish, e.g. pku=pku-worker.pub. The last one of a handle is published")
+	flagWorkerPriv = flag.String("worker-priv", "", "Private worker keys of handles this satellite is approved for, e.g. pku=pku-worker.pem")
+
+	ErrNoWorkerKey       = errors.New("no worker key")
+	ErrInvalidWorkerKeys = errors.New("invalid worker keys")
+
+	workerPubOnce  sync.Once
+	workerPubs     map[string]workerPub
+	workerPrivOnce sync.Once
+	workerPrivs    map[string]workerPriv // Key ID -> key
+)
+
+type workerPub struct {
+	id   string
+	data []byte
+}
+
+type workerPriv struct {
+	handle string
+	key    *rsa.PrivateKey
+}
+
+// Parse "h1=path,h2=path" into (handle, file content) pairs.
+func readWorkerKeys(s string, f func(handle string, data []byte) error) error {
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return ErrInvalidWorkerKeys
+		}
+		data, err := ioutil.ReadFile(kv[1])
+		if err != nil {
+			return err
+		}
+		if err := f(kv[0], data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This function could be called any times you want.
+func getWorkerPubs() map[string]workerPub {
+	workerPubOnce.Do(func() {
+		workerPubs = make(map[string]workerPub)
+		err := readWorkerKeys(*flagWorkerPub, func(handle string, data []byte) error {
+			pub, err := dispatcher.ParsePublicKey(data)
+			if err != nil {
+				return err
+			}
+			workerPubs[handle] = workerPub{
+				id:   dispatcher.KeyID(pub),
+				data: data,
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Invalid public worker keys %q: %s", *flagWorkerPub, err.Error())
+		}
+	})
+	return workerPubs
+}
+
+// This function could be called any times you want.
+func getWorkerPrivs() map[string]workerPriv {
+	workerPrivOnce.Do(func() {
+		workerPrivs = make(map[string]workerPriv)
+		err := readWorkerKeys(*flagWorkerPriv, func(handle string, data []byte) error {
+			priv, err := dispatcher.ParsePrivateKey(data)
+			if err != nil {
+				return err
+			}
+			workerPrivs[dispatcher.KeyID(&priv.PublicKey)] = workerPriv{
+				handle: handle,
+				key:    priv,
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Invalid private worker keys %q: %s", *flagWorkerPriv, err.Error())
+		}
+	})
+	return workerPrivs
+}
+
+// The public worker key of the handle users should seal credentials to, PEM encoded, and its ID.
+func WorkerPublicKey(handle string) (string, []byte, error) {
+	k, ok := getWorkerPubs()[handle]
+	if !ok {
+		return "", nil, ErrNoWorkerKey
+	}
+	return k.id, k.data, nil
+}
+
+// Selector of subtasks carrying the password, so that only satellites holding
+// the worker key get them. Nil if the password is not sealed.
+func SealedSelector(password string) dispatcher.Labels {
+	id, err := dispatcher.SealedKeyID(password)
+	if err != nil {
+		return nil
+	}
+	return dispatcher.Labels{dispatcher.WorkerKeyLabel(id): "true"}
+}
+
+// Labels of this satellite for the worker keys it holds.
+func WorkerKeyLabels() dispatcher.Labels {
+	res := make(dispatcher.Labels)
+	for id, _ := range getWorkerPrivs() {
+		res[dispatcher.WorkerKeyLabel(id)] = "true"
+	}
+	return res
+}
+
+// Replace a sealed password with what is sealed. Plain passwords are left alone.
+func unsealPassword(handle string, userID string, password *string) error {
+	if !dispatcher.IsSealed(*password) {
+		return nil
+	}
+	id, err := dispatcher.SealedKeyID(*password)
+	if err != nil {
+		return err
+	}
+	k, ok := getWorkerPrivs()[id]
+	if !ok || k.handle != handle {
+		return ErrNoWorkerKey
+	}
+	c, err := dispatcher.Unseal(k.key, *password)
+	if err != nil {
+		return err
+	}
+	if c.Handler != handle || c.UserID != userID {
+		return dispatcher.ErrSealedMismatch
+	}
+	*password = c.Password
+	return nil
+}
+
+// Seal the password to the worker key, as the user's browser or CLI does.
+func SealPassword(pub []byte, handle string, userID string, password string) (string, error) {
+	k, err := dispatcher.ParsePublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return dispatcher.Seal(k, dispatcher.SealedCredentials{
+		Handler:  handle,
+		UserID:   userID,
+		Password: password,
+	})
+}
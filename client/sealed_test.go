@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Remembers the password it logs in with.
+type passwordWorker struct {
+	password string
+}
+
+func (w *passwordWorker) Login(ctx context.Context, req *LoginRequest) (*LoginResult, error) {
+	w.password = req.Password
+	return &LoginResult{}, nil
+}
+
+func (w *passwordWorker) ListCourse(ctx context.Context, req *ListRequest) (*ListResult, error) {
+	w.password = req.Password
+	return &ListResult{}, nil
+}
+
+func (w *passwordWorker) Elect(ctx context.Context, req *ElectRequest) (*ElectResult, error) {
+	return &ElectResult{}, nil
+}
+
+func TestSealedCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icarus-worker-keys")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// Approved for pku, and holding a key of another handle.
+	write := func(name string) []byte {
+		priv, err := dispatcher.GenerateKey(1024)
+		if err != nil {
+			t.Fatalf("Error generating key: %s", err.Error())
+		}
+		ioutil.WriteFile(filepath.Join(dir, name), priv, 0600)
+		pub, _ := dispatcher.ExportPublicKey(priv)
+		return pub
+	}
+	pkuPub := write("pku.pem")
+	otherPub := write("other.pem")
+	unknownPub, _ := dispatcher.ExportPublicKey(mustGenerate(t))
+	flag.Set("worker-priv", "pku="+filepath.Join(dir, "pku.pem")+",other="+filepath.Join(dir, "other.pem"))
+
+	sealed, err := SealPassword(pkuPub, "pku", "marisa", "alice")
+	if err != nil {
+		t.Fatalf("Error sealing: %s", err.Error())
+	}
+	sel := SealedSelector(sealed)
+	if len(sel) != 1 || !sel.Selects(WorkerKeyLabels()) {
+		t.Fatalf("Satellite holding the key is not selected: %s, %s", sel, WorkerKeyLabels())
+	}
+	if SealedSelector("alice") != nil {
+		t.Fatalf("Plain password selects satellites")
+	}
+
+	w := &passwordWorker{}
+	r := typedRunner{1, StandardOperations(w), nil}
+	run := func(tp dispatcher.SubtaskType, userID string, password string) *dispatcher.SubtaskResult {
+		w.password = ""
+		sb := &dispatcher.Subtask{Version: dispatcher.ProtocolVersion, Handler: "pku", Type: tp}
+		sb.SetPayload(&LoginRequest{UserID: userID, Password: password})
+		return r.Run(context.Background(), sb)
+	}
+
+	for _, tp := range []dispatcher.SubtaskType{dispatcher.SubtaskLogin, dispatcher.SubtaskList} {
+		if res := run(tp, "marisa", sealed); res.Status != dispatcher.StatusOK || w.password != "alice" {
+			t.Fatalf("Worker did not get the unsealed password for %s: %q, %s", tp, w.password, res.Message)
+		}
+	}
+	if res := run(dispatcher.SubtaskLogin, "marisa", "alice"); res.Status != dispatcher.StatusOK || w.password != "alice" {
+		t.Fatalf("Plain password is not passed through: %q", w.password)
+	}
+
+	// Moved to another user
+	if res := run(dispatcher.SubtaskLogin, "reimu", sealed); res.Code != dispatcher.CodeBadCredentials || w.password != "" {
+		t.Fatalf("Sealed password of another user is accepted: %s", res.Code)
+	}
+	// Sealed to a key of another handle, or one this satellite does not hold
+	for _, pub := range [][]byte{otherPub, unknownPub} {
+		s, _ := SealPassword(pub, "pku", "marisa", "alice")
+		if res := run(dispatcher.SubtaskLogin, "marisa", s); res.Code != dispatcher.CodeNoWorkerKey || w.password != "" {
+			t.Fatalf("Password sealed to a wrong key is unsealed: %s", res.Code)
+		}
+	}
+}
+
+func mustGenerate(t *testing.T) []byte {
+	data, err := dispatcher.GenerateKey(1024)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err.Error())
+	}
+	return data
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Checks of `icarus-satellite -selftest`, so that a satellite set up wrong is found
+// before tasks start timing out on it.
+
+// Prober is implemented by workers that could answer a dry probe, e.g. by checking
+// the school system is reachable, without touching any user or changing anything.
+type Prober interface {
+	Probe(ctx context.Context) error
+}
+
+// A check of something a handle needs, e.g. its captcha recognizer.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+var (
+	ErrNoOperation = errors.New("no operation")
+
+	checksMu sync.Mutex
+	checks   []Check
+)
+
+// Register a check run by the self test. Handles call it in their init.
+func RegisterCheck(name string, f func(ctx context.Context) error) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+
+	checks = append(checks, Check{name, f})
+}
+
+// Checks registered, by name.
+func Checks() []Check {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+
+	res := make([]Check, len(checks))
+	copy(res, checks)
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+type probing interface {
+	probe(ctx context.Context) error
+}
+
+func (r typedRunner) probe(ctx context.Context) error {
+	if len(r.ops) == 0 {
+		return ErrNoOperation
+	}
+	for name, op := range r.ops {
+		if op.NewRequest == nil || op.Run == nil || op.NewRequest() == nil {
+			return fmt.Errorf("operation %s is incomplete", name)
+		}
+	}
+	if r.prober != nil {
+		return r.prober.Probe(ctx)
+	}
+	return nil
+}
+
+func (r legacyRunner) probe(ctx context.Context) error {
+	if p, ok := r.w.(Prober); ok {
+		return p.Probe(ctx)
+	}
+	return nil
+}
+
+// Dry probe of the worker of the handle. Workers without `Prober` pass if their
+// operation tables are complete. A panic fails the probe.
+func ProbeWorker(ctx context.Context, handle string) (err error) {
+	r, err := GetWorker(handle)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("worker crashed: %v", v)
+		}
+	}()
+	if p, ok := r.(probing); ok {
+		return p.probe(ctx)
+	}
+	return nil
+}
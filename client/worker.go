@@ -1,32 +1,205 @@
 package client
 
 import (
+	"context"
+	"fmt"
+	"runtime/debug"
 	"sync"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
 )
 
-var workers map[string]Worker
+var workers map[string]Runner
 
 // Worker is in icarus-satellite.
 //
 // What worker needs to do is to handle server's subtask and do actual response.
+// A worker exposes a table of operations, keyed by the same names its handle
+//   registers on the server side (see `dispatcher.RegisterOperation`).
+type Worker interface {
+	// Bump it when the worker changes in a way the server must know,
+	//   e.g. its result format. Servers refuse to send operations to
+	//   workers older than what they registered as `MinWorkerVersion`.
+	Version() int
+	Operations() map[dispatcher.SubtaskType]Operation
+}
+
+// Operation is one entry of a worker's operation table.
+//
+// Requests and results are typed (see protocol.go). An operation reports failures
+//   by returning an error, preferably a *WorkerError carrying a status and a code.
+type Operation struct {
+	// Makes a pointer to an empty request, which the payload is decoded into.
+	NewRequest func() interface{}
+	// Runs with the decoded request, and returns the result to be sent back.
+	// ctx is cancelled if the server cancels the subtask.
+	Run func(ctx context.Context, req interface{}) (interface{}, error)
+}
+
+// StandardWorker has the operations every handle is expected to have.
+type StandardWorker interface {
+	Login(ctx context.Context, req *LoginRequest) (*LoginResult, error)
+	ListCourse(ctx context.Context, req *ListRequest) (*ListResult, error)
+	Elect(ctx context.Context, req *ElectRequest) (*ElectResult, error)
+}
+
+// Operation table of a StandardWorker. Workers with more operations add theirs to it.
+func StandardOperations(w StandardWorker) map[dispatcher.SubtaskType]Operation {
+	return map[dispatcher.SubtaskType]Operation{
+		dispatcher.SubtaskLogin: {
+			NewRequest: func() interface{} { return &LoginRequest{} },
+			Run: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return w.Login(ctx, req.(*LoginRequest))
+			},
+		},
+		dispatcher.SubtaskList: {
+			NewRequest: func() interface{} { return &ListRequest{} },
+			Run: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return w.ListCourse(ctx, req.(*ListRequest))
+			},
+		},
+		dispatcher.SubtaskElect: {
+			NewRequest: func() interface{} { return &ElectRequest{} },
+			Run: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return w.Elect(ctx, req.(*ElectRequest))
+			},
+		},
+	}
+}
+
+// LegacyWorker speaks the legacy protocol (version 0).
+//
 // All datum are transfered in []string so the worker need to understand server's
 //   request correctly and generate suitable response. Errors should be coded in
 //   response so worker cannot generate any Go-style errors.
-type Worker interface {
+type LegacyWorker interface {
 	Login(data []string) []string
 	ListCourse(data []string) []string
 	Elect(data []string) []string
 }
 
+// Runner runs a subtask pulled from the dispatcher and makes its result.
+// Registered workers are wrapped into runners.
+type Runner interface {
+	Run(ctx context.Context, sb *dispatcher.Subtask) *dispatcher.SubtaskResult
+	// Version of the worker. Legacy workers are version 0.
+	Version() int
+	// Names of the operations this runner supports.
+	Operations() []dispatcher.SubtaskType
+}
+
+func UnsupportedResult(code string, message string) *dispatcher.SubtaskResult {
+	return dispatcher.FailedResult(dispatcher.StatusUnsupported, code, message)
+}
+
+// Result of a worker that panicked with v, so that the server could find the poison input.
+func CrashedResult(v interface{}, stack []byte) *dispatcher.SubtaskResult {
+	res := dispatcher.FailedResult(dispatcher.StatusFailed, dispatcher.CodeWorkerCrashed, fmt.Sprintf("worker crashed: %v", v))
+	res.Stack = string(stack)
+	return res
+}
+
+// Run the subtask, turning a panic of the runner into `CrashedResult`.
+// Only Go panics are recovered: a crash in C code, e.g. the captcha recognizer
+// called through cgo, still takes the whole satellite down.
+func RunSafely(ctx context.Context, r Runner, sb *dispatcher.Subtask) (res *dispatcher.SubtaskResult) {
+	defer func() {
+		if v := recover(); v != nil {
+			res = CrashedResult(v, debug.Stack())
+		}
+	}()
+	return r.Run(ctx, sb)
+}
+
+func unknownOperation(sb *dispatcher.Subtask) *dispatcher.SubtaskResult {
+	return UnsupportedResult(dispatcher.CodeUnknownOperation,
+		fmt.Sprintf("handler %s has no operation %s", sb.Handler, sb.Type))
+}
+
+type typedRunner struct {
+	version int
+	ops     map[dispatcher.SubtaskType]Operation
+	prober  Prober // Nil if the worker has no dry probe
+}
+
+func (r typedRunner) Run(ctx context.Context, sb *dispatcher.Subtask) *dispatcher.SubtaskResult {
+	if sb.Version != dispatcher.ProtocolVersion {
+		return dispatcher.FailedResult(dispatcher.StatusInvalidRequest, dispatcher.CodeUnsupportedVersion,
+			fmt.Sprintf("protocol version %d is not supported", sb.Version))
+	}
+
+	op, ok := r.ops[sb.Type]
+	if !ok {
+		return unknownOperation(sb)
+	}
+	req := op.NewRequest()
+	if err := sb.DecodePayload(req); err != nil {
+		return dispatcher.FailedResult(dispatcher.StatusInvalidRequest, dispatcher.CodeBadPayload, err.Error())
+	}
+	if c, ok := req.(credentialed); ok {
+		userID, password := c.credentials()
+		err := unsealPassword(sb.Handler, userID, password)
+		if err == ErrNoWorkerKey {
+			return UnsupportedResult(dispatcher.CodeNoWorkerKey, err.Error())
+		} else if err != nil {
+			return dispatcher.FailedResult(dispatcher.StatusInvalidRequest, dispatcher.CodeBadCredentials, err.Error())
+		}
+	}
+	return resultOf(op.Run(ctx, req))
+}
+
+func (r typedRunner) Version() int {
+	return r.version
+}
+
+func (r typedRunner) Operations() []dispatcher.SubtaskType {
+	res := make([]dispatcher.SubtaskType, 0)
+	for k, _ := range r.ops {
+		res = append(res, k)
+	}
+	return res
+}
+
+// legacyRunner adapts a LegacyWorker, passing `Data` through untouched.
+type legacyRunner struct {
+	w LegacyWorker
+}
+
+// Legacy workers cannot be aborted.
+func (r legacyRunner) Run(ctx context.Context, sb *dispatcher.Subtask) *dispatcher.SubtaskResult {
+	var res []string
+	switch sb.Type {
+	case dispatcher.SubtaskLogin:
+		res = r.w.Login(sb.Data)
+	case dispatcher.SubtaskList:
+		res = r.w.ListCourse(sb.Data)
+	case dispatcher.SubtaskElect:
+		res = r.w.Elect(sb.Data)
+	default:
+		return unknownOperation(sb)
+	}
+	return &dispatcher.SubtaskResult{
+		Data: res,
+	}
+}
+
+func (r legacyRunner) Version() int {
+	return 0
+}
+
+func (r legacyRunner) Operations() []dispatcher.SubtaskType {
+	return dispatcher.LegacyOperations
+}
+
 var workerIniter sync.Once
 
 func initWorker() {
 	workerIniter.Do(func() {
-		workers = make(map[string]Worker)
+		workers = make(map[string]Runner)
 	})
 }
 
-func RegisterWorker(handle string, w Worker) error {
+func registerRunner(handle string, r Runner) error {
 	initWorker()
 	if len(handle) > handleNameLengthLimit {
 		return ErrHandleNameTooLong
@@ -37,13 +210,23 @@ func RegisterWorker(handle string, w Worker) error {
 		return ErrHandleExists
 	}
 
-	workers[handle] = w
+	workers[handle] = r
 	return nil
 }
 
-func RegisteredWorker() map[string]Worker {
+func RegisterWorker(handle string, w Worker) error {
+	p, _ := w.(Prober)
+	return registerRunner(handle, typedRunner{w.Version(), w.Operations(), p})
+}
+
+// Register a worker that still speaks the legacy []string protocol.
+func RegisterLegacyWorker(handle string, w LegacyWorker) error {
+	return registerRunner(handle, legacyRunner{w})
+}
+
+func RegisteredWorker() map[string]Runner {
 	initWorker()
-	res := make(map[string]Worker)
+	res := make(map[string]Runner)
 	for k, v := range workers {
 		res[k] = v
 	}
@@ -59,7 +242,21 @@ func RegisteredWorkerList() []string {
 	return res
 }
 
-func GetWorker(handle string) (Worker, error) {
+// Capabilities of all registered workers, to be advertised to the dispatcher.
+func WorkerCapabilities() []dispatcher.Capability {
+	initWorker()
+	res := make([]dispatcher.Capability, 0)
+	for k, v := range workers {
+		res = append(res, dispatcher.Capability{
+			Handler:       k,
+			WorkerVersion: v.Version(),
+			Operations:    v.Operations(),
+		})
+	}
+	return res
+}
+
+func GetWorker(handle string) (Runner, error) {
 	initWorker()
 	w, ok := workers[handle]
 	if !ok {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
@@ -39,11 +40,11 @@ func main() {
 		os.Exit(-1)
 	}
 
-	server.InitDefaultDispatcher()
+	disp := server.NewDispatcher(1024, regList)
 	go func() {
 		log.Infof("Launching local server on %s...", localListen)
 		mux := http.NewServeMux()
-		mux.Handle("/", server.DefaultDispatcher)
+		mux.Handle("/", disp)
 		panic(http.ListenAndServe(localListen, mux))
 	}()
 
@@ -84,12 +85,12 @@ func main() {
 		panic(err)
 	}
 
-	user, err := cli.MakeUser(username, password)
+	user, err := cli.MakeUser(disp, username, password)
 	if err != nil {
 		log.Errorf("Fatal error occured when making user: %s\n", err.Error())
 		os.Exit(1)
 	}
-	courses, err := user.ListCourse()
+	courses, err := user.ListCourse(context.Background())
 	if err != nil {
 		log.Errorf("Fatal error occured when retrieving courses: %s\n", err.Error())
 		os.Exit(1)
@@ -116,7 +117,7 @@ func main() {
 		}
 	}
 
-	course, err := client.MakeCourceByData(cli, courses[idx])
+	course, err := client.MakeCourceByData(cli, disp, courses[idx])
 	if err != nil {
 		log.Errorf("Fatal error occured when making course: %s\n", err.Error())
 		os.Exit(1)
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -12,9 +17,13 @@ import (
 )
 
 var (
-	flagRoot     = flag.String("server", "http://127.0.0.1:8001", "URL of Icarus server")
-	flagDelay    = flag.Int("delay", 200, "Delay before fetching the next task (millisecond)")
-	flagRoutines = flag.Int("r", 8, "Concurrent routines")
+	flagRoot        = flag.String("server", "http://127.0.0.1:8001", "URL of Icarus server, or comma separated URLs, each optionally followed by =weight")
+	flagDelay       = flag.Int("delay", 200, "Delay before fetching the next task (millisecond)")
+	flagRoutines    = flag.Int("r", 8, "Most concurrent routines, scaled up to when the server has a backlog")
+	flagMinRoutines = flag.Int("r-min", 1, "Fewest concurrent routines, scaled down to when the server is quiet")
+	flagGrace       = flag.Duration("grace", 30*time.Second, "How long to wait for subtasks in flight on SIGTERM")
+	flagStatusBind  = flag.String("status", "", "Bind address of /healthz and /status, e.g. 127.0.0.1:8002 (empty to disable)")
+	flagSelfTest    = flag.Bool("selftest", false, "Check the public key, servers, captcha and workers, print a report and exit")
 )
 
 func main() {
@@ -25,13 +34,41 @@ func main() {
 	fmt.Println("Icarus Satellite")
 	fmt.Println("----------------")
 
+	if *flagSelfTest {
+		p := satellite.NewPostOffice(*flagRoot, client.WorkerCapabilities())
+		if !satellite.WriteReport(os.Stdout, p.SelfTest()) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Infof("Fetching tasks from %s", *flagRoot)
 	log.Infof("Avaliable handlers: %v", client.RegisteredWorkerList())
+	log.Infof("Labels: %s", satellite.Labels())
 
-	for i := 1; i < *flagRoutines; i++ {
-		go satellite.StandardSatellite(*flagRoot, delay)
+	s := satellite.NewSatellite(*flagRoot, delay)
+
+	// Polls get it later if the server could not be reached now.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := s.PostOffice().FetchConfig(ctx); err != nil {
+		log.Warnf("Error fetching config: %s", err.Error())
 	}
+	cancel()
+
+	go s.RunPool(*flagMinRoutines, *flagRoutines)
 
-	// And do it together
-	satellite.StandardSatellite(*flagRoot, delay)
+	if *flagStatusBind != "" {
+		go func() {
+			log.Infof("Status Handler at %s", *flagStatusBind)
+			log.Fatalf("Error serving status: %s", http.ListenAndServe(*flagStatusBind, s.StatusHandler()))
+		}()
+	}
+
+	// Stop pulling, and let subtasks in flight finish and their results be sent back.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	log.Infof("Got %s", <-sig)
+	if !s.Shutdown(*flagGrace) {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+var (
+	errKeysUnreadable = errors.New("some keys could not be read")
+	errNoUser         = errors.New("-handle and -userid are required")
+)
+
+const keysUsage = `Usage: icarus keys <command> [arguments]
+
+Commands:
+  gen  [-bits 2048] [-out private.pem]               Generate a private key for the server
+  pub  [-in private.pem] [-out public.pem]           Export the public half for satellites
+  list [file ...]                                    List IDs of keys, private or public (default: -priv)
+  seal -handle h -userid u [-pub worker.pub]         Seal a password read from stdin to a worker key
+`
+
+// `icarus keys ...`. Returns the exit code.
+func runKeys(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, keysUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "gen":
+		err = keysGen(args[1:])
+	case "pub":
+		err = keysPub(args[1:])
+	case "list":
+		err = keysList(args[1:])
+	case "seal":
+		err = keysSeal(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, keysUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "icarus keys %s: %s\n", args[0], err.Error())
+		return 1
+	}
+	return 0
+}
+
+// Write data to path, or to stdout if path is "-". Never overwrites.
+func writeKeyFile(path string, data []byte, perm os.FileMode) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+func keysGen(args []string) error {
+	fs := flag.NewFlagSet("icarus keys gen", flag.ExitOnError)
+	bits := fs.Int("bits", dispatcher.KeyBits, "Key size in bits")
+	out := fs.String("out", "private.pem", "Path to write the private key to, or - for stdout")
+	fs.Parse(args)
+
+	data, err := dispatcher.GenerateKey(*bits)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(*out, data, 0600); err != nil {
+		return err
+	}
+	id, _ := dispatcher.PEMKeyID(data)
+	fmt.Fprintf(os.Stderr, "Generated key %s\n", id)
+	return nil
+}
+
+func keysPub(args []string) error {
+	fs := flag.NewFlagSet("icarus keys pub", flag.ExitOnError)
+	in := fs.String("in", "private.pem", "Path of the private key")
+	out := fs.String("out", "public.pem", "Path to write the public key to, or - for stdout")
+	fs.Parse(args)
+
+	priv, err := ioutil.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	data, err := dispatcher.ExportPublicKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(*out, data, 0644); err != nil {
+		return err
+	}
+	id, _ := dispatcher.PEMKeyID(data)
+	fmt.Fprintf(os.Stderr, "Exported public key %s\n", id)
+	return nil
+}
+
+func keysList(args []string) error {
+	paths := args
+	if len(paths) == 0 {
+		paths = strings.Split(flag.Lookup("priv").Value.String(), ",")
+	}
+	failed := false
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			var id string
+			id, err = dispatcher.PEMKeyID(data)
+			if err == nil {
+				fmt.Printf("%s  %s\n", id, path)
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+		failed = true
+	}
+	if failed {
+		return errKeysUnreadable
+	}
+	return nil
+}
+
+// What the browser does for users who would rather not let the server read their password.
+func keysSeal(args []string) error {
+	fs := flag.NewFlagSet("icarus keys seal", flag.ExitOnError)
+	pub := fs.String("pub", "worker.pub", "Path of the public worker key of the handle")
+	handle := fs.String("handle", "", "Handle the password is for")
+	userID := fs.String("userid", "", "User the password is for")
+	fs.Parse(args)
+
+	if *handle == "" || *userID == "" {
+		return errNoUser
+	}
+	data, err := ioutil.ReadFile(*pub)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	sealed, err := client.SealPassword(data, *handle, *userID, strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(sealed)
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/applepi-icpc/icarus/client"
@@ -19,15 +20,23 @@ var (
 	flagCORS     = flag.Bool("cors", false, "Enable CORS")
 	flagAPIBind  = flag.String("api", ":8000", "API bind address")
 	flagTaskBind = flag.String("task", ":8001", "Task bind address")
+
+	flagAffinityFallback = flag.Duration("affinity-fallback", server.AffinityFallback, "How long a subtask waits for the satellite it has affinity with (0 to disable affinity)")
 )
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "keys" {
+		os.Exit(runKeys(flag.Args()[1:]))
+	}
 
 	fmt.Println("Icarus Server")
 	fmt.Println("-------------")
 
-	disp := server.NewDispatcher(1024, client.RegisteredList())
+	settings := server.DefaultSettings()
+	settings.AffinityFallback = *flagAffinityFallback
+	disp := server.NewDispatcherWithSettings(1024, client.RegisteredList(), settings)
+	disp.InitPrivKey()
 
 	go func() {
 		log.Infof("Task Handler at %s", *flagTaskBind)
@@ -37,17 +46,16 @@ func main() {
 	}()
 
 	// Start all tasks
-	manager.InitManager()
+	m := manager.NewManager(disp)
 	{
-		tasks := manager.ListTasks()
+		tasks := m.ListTasks()
 		for _, task := range tasks {
 			task.Start()
 		}
 	}
 
 	log.Infof("API Handler at %s", *flagAPIBind)
-	handler.InitHandler()
-	var handler http.Handler = http.DefaultServeMux
+	var api http.Handler = handler.NewHandler(disp, m)
 	if *flagCORS {
 		c := cors.New(cors.Options{
 			AllowedOrigins:   []string{"*"},
@@ -55,7 +63,7 @@ func main() {
 			AllowedHeaders:   []string{"*"},
 			AllowCredentials: true,
 		})
-		handler = c.Handler(handler)
+		api = c.Handler(api)
 	}
-	panic(http.ListenAndServe(*flagAPIBind, context.ClearHandler(handler)))
+	panic(http.ListenAndServe(*flagAPIBind, context.ClearHandler(api)))
 }
@@ -1,13 +1,19 @@
 package dispatcher_test
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
 	"flag"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/applepi-icpc/icarus/dispatcher"
 	"github.com/applepi-icpc/icarus/dispatcher/satellite"
 	"github.com/applepi-icpc/icarus/dispatcher/server"
 )
@@ -22,7 +28,8 @@ func TestEncryptAndDecrypt(t *testing.T) {
 	plain := "魔理沙の…バカ"
 	t.Logf("Key: %s", key)
 
-	encrypted, err := server.Encrypt(plain, key)
+	d := server.NewDispatcher(1024, nil)
+	encrypted, err := d.Encrypt(plain, satellite.KeyID(), key)
 	if err != nil {
 		t.Fatalf("Error occured when encrypting: %s", err.Error())
 	}
@@ -59,3 +66,66 @@ func TestEncryptAndDecrypt(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icarus-keys")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	priv, err := dispatcher.GenerateKey(1024)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err.Error())
+	}
+	path := filepath.Join(dir, "next.pem")
+	ioutil.WriteFile(path, priv, 0600)
+	pub, err := dispatcher.ExportPublicKey(priv)
+	if err != nil {
+		t.Fatalf("Error exporting public key: %s", err.Error())
+	}
+	pubKey, _ := dispatcher.ParsePublicKey(pub)
+	next := dispatcher.KeyID(pubKey)
+
+	orig := []byte("0123456789abcdef0123456789abcdef")
+	raw, _ := rsa.EncryptPKCS1v15(crand.Reader, pubKey, orig)
+	cipher := base64.StdEncoding.EncodeToString(raw)
+	d := server.NewDispatcher(1024, nil)
+	if _, err := d.GetNakedKey(next, cipher); err != server.ErrUnknownKey {
+		t.Fatalf("Key not loaded yet is accepted: %v", err)
+	}
+
+	id, err := d.LoadPrivKey(path)
+	if err != nil || id != next {
+		t.Fatalf("Error loading key: %v (%s, %s expected)", err, id, next)
+	}
+	key, err := d.GetNakedKey(next, cipher)
+	if err != nil || !bytes.Equal(key, orig) {
+		t.Fatalf("Cipher of the new key is not decrypted: %v", err)
+	}
+	if _, err := server.NewDispatcher(1024, nil).GetNakedKey(next, cipher); err != server.ErrUnknownKey {
+		t.Fatalf("Key loaded into another dispatcher is accepted: %v", err)
+	}
+
+	// Satellites still on the old key, and legacy ones, keep working.
+	orig, cipher = satellite.GenKey()
+	for _, id := range []string{satellite.KeyID(), ""} {
+		key, err := d.GetNakedKey(id, cipher)
+		if err != nil || !bytes.Equal(key, orig) {
+			t.Fatalf("Cipher of the old key is not decrypted with key %q: %v", id, err)
+		}
+	}
+	if len(d.Keys()) != 2 || !d.Keys()[0].Primary || d.Keys()[0].ID != satellite.KeyID() {
+		t.Fatalf("Unexpected keys: %v", d.Keys())
+	}
+
+	if d.RetirePrivKey(satellite.KeyID()) != server.ErrPrimaryKey {
+		t.Fatalf("Primary key is retired")
+	}
+	if err := d.RetirePrivKey(next); err != nil {
+		t.Fatalf("Error retiring key: %s", err.Error())
+	}
+	if _, err := d.GetNakedKey(next, cipher); err != server.ErrUnknownKey {
+		t.Fatalf("Retired key is accepted: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package dispatcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// Configuration the server pushes to satellites, so that they could be tuned
+// without being redeployed. Fields left unset keep what the satellite was started with.
+type SatelliteConfig struct {
+	// Delay before polling again, see `-delay`.
+	DelayMs *int `json:"delay_ms,omitempty"`
+
+	// Bounds of concurrent routines, see `-r-min` and `-r`.
+	MinRoutines *int `json:"min_routines,omitempty"`
+	MaxRoutines *int `json:"max_routines,omitempty"`
+
+	// Handlers to take subtasks of, among those registered. `AllHandlers` enables all of them.
+	Handlers []string `json:"handlers,omitempty"`
+
+	// Egress proxies of workers, in the form of `-proxies`. Empty means direct.
+	Proxies *string `json:"proxies,omitempty"`
+
+	// Level of logs, e.g. "debug" or "warning".
+	LogLevel string `json:"log_level,omitempty"`
+}
+
+// In `SatelliteConfig.Handlers`, enables every handler registered.
+const AllHandlers = "*"
+
+// Configuration for satellites by scope. The configuration of a satellite is the defaults,
+// overridden by every label profile selecting it in order, then by its own profile.
+type ConfigProfiles struct {
+	Defaults   SatelliteConfig            `json:"defaults"`
+	Labels     []LabelConfig              `json:"labels,omitempty"`
+	Satellites map[string]SatelliteConfig `json:"satellites,omitempty"` // Satellite -> Config
+}
+
+type LabelConfig struct {
+	Selector Labels          `json:"selector"`
+	Config   SatelliteConfig `json:"config"`
+}
+
+// The configuration of a satellite, and its version, which changes with it.
+type SatelliteProfile struct {
+	Version string          `json:"version"`
+	Config  SatelliteConfig `json:"config"`
+}
+
+var (
+	ErrInvalidConfig = errors.New("invalid satellite config")
+)
+
+// Fields set in o override those in c.
+func (c SatelliteConfig) Merge(o SatelliteConfig) SatelliteConfig {
+	if o.DelayMs != nil {
+		c.DelayMs = o.DelayMs
+	}
+	if o.MinRoutines != nil {
+		c.MinRoutines = o.MinRoutines
+	}
+	if o.MaxRoutines != nil {
+		c.MaxRoutines = o.MaxRoutines
+	}
+	if o.Handlers != nil {
+		c.Handlers = o.Handlers
+	}
+	if o.Proxies != nil {
+		c.Proxies = o.Proxies
+	}
+	if o.LogLevel != "" {
+		c.LogLevel = o.LogLevel
+	}
+	return c
+}
+
+func (c SatelliteConfig) Validate() error {
+	for _, v := range []*int{c.DelayMs, c.MinRoutines, c.MaxRoutines} {
+		if v != nil && *v < 0 {
+			return ErrInvalidConfig
+		}
+	}
+	if c.MinRoutines != nil && c.MaxRoutines != nil && *c.MinRoutines > *c.MaxRoutines {
+		return ErrInvalidConfig
+	}
+	return nil
+}
+
+// Whether the handler is enabled.
+func (c SatelliteConfig) Enables(handler string) bool {
+	if c.Handlers == nil {
+		return true
+	}
+	for _, v := range c.Handlers {
+		if v == handler || v == AllHandlers {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ConfigProfiles) Validate() error {
+	if err := p.Defaults.Validate(); err != nil {
+		return err
+	}
+	for _, v := range p.Labels {
+		if err := v.Config.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, v := range p.Satellites {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The profile of the satellite.
+func (p ConfigProfiles) Resolve(satellite string, labels Labels) SatelliteProfile {
+	c := p.Defaults
+	for _, v := range p.Labels {
+		if v.Selector.Selects(labels) {
+			c = c.Merge(v.Config)
+		}
+	}
+	if v, ok := p.Satellites[satellite]; ok {
+		c = c.Merge(v)
+	}
+	return SatelliteProfile{
+		Version: ConfigVersion(c),
+		Config:  c,
+	}
+}
+
+// Short hash of the configuration, the same for the same configuration.
+func ConfigVersion(c SatelliteConfig) string {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Request of satellites fetching their configuration at startup.
+type ConfigRequest struct {
+	Satellite string `json:"satellite"`
+	Labels    Labels `json:"labels,omitempty"`
+
+	// As in `TaskRequest`. The profile is encrypted with the key in Cipher.
+	Cipher string `json:"cipher"`
+	KeyID  string `json:"key_id,omitempty"`
+}
+
+type ConfigResponse struct {
+	// Encrypted `SatelliteProfile`, encoded in Base64.
+	Content string `json:"content"`
+}
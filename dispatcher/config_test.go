@@ -0,0 +1,54 @@
+package dispatcher_test
+
+import (
+	"testing"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestConfigProfiles(t *testing.T) {
+	direct := ""
+	p := dispatcher.ConfigProfiles{
+		Defaults: dispatcher.SatelliteConfig{DelayMs: intPtr(200), MaxRoutines: intPtr(4)},
+		Labels: []dispatcher.LabelConfig{
+			{Selector: dispatcher.Labels{"network": "campus"}, Config: dispatcher.SatelliteConfig{MaxRoutines: intPtr(8), Proxies: &direct}},
+			{Selector: dispatcher.Labels{"isp": "cernet"}, Config: dispatcher.SatelliteConfig{LogLevel: "debug"}},
+		},
+		Satellites: map[string]dispatcher.SatelliteConfig{
+			"alice": {DelayMs: intPtr(50), Handlers: []string{"pku"}},
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("Error validating profiles: %s", err.Error())
+	}
+
+	plain := p.Resolve("marisa", nil)
+	if *plain.Config.DelayMs != 200 || *plain.Config.MaxRoutines != 4 || plain.Config.Proxies != nil || !plain.Config.Enables("thu") {
+		t.Fatalf("Wrong config of a plain satellite: %+v", plain.Config)
+	}
+	campus := p.Resolve("marisa", dispatcher.Labels{"network": "campus", "isp": "cernet"})
+	if *campus.Config.MaxRoutines != 8 || campus.Config.Proxies == nil || campus.Config.LogLevel != "debug" {
+		t.Fatalf("Wrong config of a labelled satellite: %+v", campus.Config)
+	}
+	alice := p.Resolve("alice", dispatcher.Labels{"network": "campus"})
+	if *alice.Config.DelayMs != 50 || *alice.Config.MaxRoutines != 8 || !alice.Config.Enables("pku") || alice.Config.Enables("thu") {
+		t.Fatalf("Wrong config of a satellite of its own: %+v", alice.Config)
+	}
+
+	// Versions follow configurations.
+	if plain.Version == campus.Version || plain.Version == alice.Version {
+		t.Fatalf("Different configs have the same version %s", plain.Version)
+	}
+	if v := p.Resolve("reimu", nil).Version; v != plain.Version {
+		t.Fatalf("Same configs have different versions %s and %s", v, plain.Version)
+	}
+
+	p.Satellites["alice"] = dispatcher.SatelliteConfig{MinRoutines: intPtr(2), MaxRoutines: intPtr(1)}
+	if err := p.Validate(); err != dispatcher.ErrInvalidConfig {
+		t.Fatalf("Invalid bounds of routines are taken: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package dispatcher
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+)
+
+// Key pairs of servers and satellites. See `TaskRequest.KeyID`.
+
+const (
+	// Bits of keys generated by `GenerateKey`.
+	KeyBits = 2048
+
+	// Hex digits of a key ID.
+	KeyIDLength = 16
+)
+
+var (
+	ErrNoKeyFound  = errors.New("no key found")
+	ErrNotRSAKey   = errors.New("not an RSA key")
+	ErrInvalidBits = errors.New("invalid key size")
+)
+
+// ID of the key pair, the first hex digits of the SHA-256 of the DER encoded public key.
+// Both halves of a key pair have the same ID.
+func KeyID(pub *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])[:KeyIDLength]
+}
+
+// Generate a private key, PEM encoded.
+func GenerateKey(bits int) ([]byte, error) {
+	if bits < 1024 {
+		return nil, ErrInvalidBits
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	}), nil
+}
+
+// The public half of a PEM encoded private key, PEM encoded, for satellites.
+func ExportPublicKey(privPEM []byte) ([]byte, error) {
+	priv, err := ParsePrivateKey(privPEM)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), nil
+}
+
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNoKeyFound
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNoKeyFound
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrNotRSAKey
+	}
+	return rsaPub, nil
+}
+
+// ID of a PEM encoded key, private or public.
+func PEMKeyID(data []byte) (string, error) {
+	if priv, err := ParsePrivateKey(data); err == nil {
+		return KeyID(&priv.PublicKey), nil
+	}
+	pub, err := ParsePublicKey(data)
+	if err != nil {
+		return "", err
+	}
+	return KeyID(pub), nil
+}
@@ -0,0 +1,45 @@
+package dispatcher_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+func TestKeyID(t *testing.T) {
+	priv, _ := ioutil.ReadFile("private.pem")
+	pub, _ := ioutil.ReadFile("public.pem")
+	privID, err := dispatcher.PEMKeyID(priv)
+	if err != nil {
+		t.Fatalf("Error reading private key: %s", err.Error())
+	}
+	pubID, err := dispatcher.PEMKeyID(pub)
+	if err != nil {
+		t.Fatalf("Error reading public key: %s", err.Error())
+	}
+	if privID != pubID || len(privID) != dispatcher.KeyIDLength {
+		t.Fatalf("Halves of a key pair have IDs %s and %s", privID, pubID)
+	}
+
+	generated, err := dispatcher.GenerateKey(1024)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err.Error())
+	}
+	exported, err := dispatcher.ExportPublicKey(generated)
+	if err != nil {
+		t.Fatalf("Error exporting public key: %s", err.Error())
+	}
+	genID, _ := dispatcher.PEMKeyID(generated)
+	expID, _ := dispatcher.PEMKeyID(exported)
+	if genID != expID || genID == privID {
+		t.Fatalf("Unexpected IDs of a generated key pair: %s and %s", genID, expID)
+	}
+
+	if _, err := dispatcher.PEMKeyID([]byte("not a key")); err != dispatcher.ErrNoKeyFound {
+		t.Fatalf("Garbage is taken as a key: %v", err)
+	}
+	if _, err := dispatcher.GenerateKey(512); err != dispatcher.ErrInvalidBits {
+		t.Fatalf("Weak key is generated: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package dispatcher
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels describe a satellite, e.g. network=campus.
+// Also used as a selector: a subtask with a selector only runs on satellites
+// having all labels in the selector.
+type Labels map[string]string
+
+var (
+	ErrInvalidLabels = errors.New("invalid labels")
+)
+
+// Parse labels in the form of "k1=v1,k2=v2".
+func ParseLabels(s string) (Labels, error) {
+	res := make(Labels)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ErrInvalidLabels
+		}
+		res[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return res, nil
+}
+
+// In the form of "k1=v1,k2=v2", sorted by keys.
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k, _ := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, l[k]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Whether a satellite with labels satisfies sel. An empty selector selects everyone.
+func (sel Labels) Selects(labels Labels) bool {
+	for k, v := range sel {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Labels in sel override those in base.
+func MergeLabels(base Labels, sel Labels) Labels {
+	if len(base) == 0 {
+		return sel
+	}
+	res := make(Labels)
+	for k, v := range base {
+		res[k] = v
+	}
+	for k, v := range sel {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,30 @@
+package dispatcher_test
+
+import (
+	"testing"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+func TestLabels(t *testing.T) {
+	labels, err := dispatcher.ParseLabels("network=campus, isp=cernet")
+	if err != nil {
+		t.Fatalf("Error parsing labels: %s", err.Error())
+	}
+	if labels.String() != "isp=cernet,network=campus" {
+		t.Fatalf("Wrong labels: %s", labels)
+	}
+	if _, err = dispatcher.ParseLabels("campus"); err != dispatcher.ErrInvalidLabels {
+		t.Fatalf("Labels without values should be invalid, got %v", err)
+	}
+
+	if !(dispatcher.Labels{"network": "campus"}).Selects(labels) {
+		t.Fatalf("Selector should select %s", labels)
+	}
+	if (dispatcher.Labels{"network": "cloud"}).Selects(labels) {
+		t.Fatalf("Selector should not select %s", labels)
+	}
+	if !(dispatcher.Labels{}).Selects(nil) {
+		t.Fatalf("Empty selector should select everyone")
+	}
+}
@@ -0,0 +1,119 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// SubtaskType names an operation of a handler, e.g. "login" or "elect".
+type SubtaskType string
+
+// Operations every handler is expected to have.
+const (
+	SubtaskLogin SubtaskType = "login"
+	SubtaskList  SubtaskType = "list"
+	SubtaskElect SubtaskType = "elect"
+)
+
+// Operations of legacy satellites, which do not advertise their capabilities.
+var LegacyOperations = []SubtaskType{SubtaskLogin, SubtaskList, SubtaskElect}
+
+// Numeric codes of the operations in the legacy protocol.
+// Subtasks of these operations are still encoded with their codes,
+// so that legacy satellites could decode them.
+var legacyCodes = map[SubtaskType]int{
+	SubtaskLogin: 0,
+	SubtaskList:  1,
+	SubtaskElect: 2,
+}
+
+func (t SubtaskType) MarshalJSON() ([]byte, error) {
+	if code, ok := legacyCodes[t]; ok {
+		return json.Marshal(code)
+	}
+	return json.Marshal(string(t))
+}
+
+func (t *SubtaskType) UnmarshalJSON(b []byte) error {
+	var code int
+	if err := json.Unmarshal(b, &code); err == nil {
+		for k, v := range legacyCodes {
+			if v == code {
+				*t = k
+				return nil
+			}
+		}
+		return ErrUnknownOperation
+	}
+
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	*t = SubtaskType(name)
+	return nil
+}
+
+// Operation is registered by a handle (server part) for each kind of subtask it sends.
+type Operation struct {
+	Name SubtaskType
+
+	// How long the dispatcher waits for the result, queueing time included.
+	Timeout time.Duration
+
+	// Satellites whose worker is older than this never get this operation.
+	MinWorkerVersion int
+
+	// Default selector of subtasks of this operation. See `Subtask.Selector`.
+	Selector Labels
+}
+
+var (
+	ErrUnknownOperation = errors.New("unknown operation")
+	ErrOperationExists  = errors.New("operation exists")
+)
+
+var (
+	opmu       sync.RWMutex
+	operations = make(map[string]map[SubtaskType]Operation) // Handler -> Name -> Operation
+)
+
+func RegisterOperation(handler string, op Operation) error {
+	opmu.Lock()
+	defer opmu.Unlock()
+
+	ops, ok := operations[handler]
+	if !ok {
+		ops = make(map[SubtaskType]Operation)
+		operations[handler] = ops
+	}
+	if _, ok := ops[op.Name]; ok {
+		return ErrOperationExists
+	}
+	ops[op.Name] = op
+	return nil
+}
+
+func GetOperation(handler string, name SubtaskType) (Operation, error) {
+	opmu.RLock()
+	defer opmu.RUnlock()
+
+	op, ok := operations[handler][name]
+	if !ok {
+		return Operation{}, ErrUnknownOperation
+	}
+	return op, nil
+}
+
+func RegisteredOperations(handler string) []Operation {
+	opmu.RLock()
+	defer opmu.RUnlock()
+
+	res := make([]Operation, 0)
+	for _, v := range operations[handler] {
+		res = append(res, v)
+	}
+	return res
+}
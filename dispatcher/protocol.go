@@ -0,0 +1,161 @@
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Version of the typed subtask protocol.
+//
+// Version 0 is the legacy protocol, where requests and results are positional []string
+// in `Data`. From version 1 on, requests and results are JSON objects in `Payload`,
+// and results carry a status, an error code and a message.
+const ProtocolVersion = 1
+
+type ResultStatus int
+
+const (
+	// The operation succeeded, and the payload holds its result.
+	StatusOK ResultStatus = iota
+	// Something went wrong. Code and Message tell what.
+	StatusFailed
+	// The school system refused the request, e.g. wrong password.
+	StatusRejected
+	// The login session is no longer valid.
+	StatusSessionExpired
+	// The worker could not understand the request.
+	StatusInvalidRequest
+	// The satellite has no such handler, or the handler has no such operation.
+	StatusUnsupported
+	// The school system blocked the satellite, e.g. it sees a ban page.
+	// The dispatcher quarantines the satellite for the handler.
+	StatusBlocked
+	// The satellite could not run it for now, e.g. it has no healthy proxy to go out from.
+	// It tells nothing about the school system or the satellite's standing with it,
+	// so breakers and quarantine ignore it.
+	StatusUnavailable
+)
+
+var statusNames = map[ResultStatus]string{
+	StatusOK:             "ok",
+	StatusFailed:         "failed",
+	StatusRejected:       "rejected",
+	StatusSessionExpired: "session expired",
+	StatusInvalidRequest: "invalid request",
+	StatusUnsupported:    "unsupported",
+	StatusBlocked:        "upstream blocked",
+	StatusUnavailable:    "unavailable",
+}
+
+func (s ResultStatus) String() string {
+	name, ok := statusNames[s]
+	if !ok {
+		return fmt.Sprintf("status %d", int(s))
+	}
+	return name
+}
+
+// Error codes shared by all handlers. Handlers may define their own ones.
+const (
+	CodeBadPayload         = "bad_payload"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeUnknownHandler     = "unknown_handler"
+	CodeUnknownOperation   = "unknown_operation"
+	CodeNoWorkerKey        = "no_worker_key"
+	CodeBadCredentials     = "bad_credentials"
+	CodeWorkerCrashed      = "worker_crashed"
+	CodeNoEgress           = "no_egress"
+)
+
+var (
+	ErrLegacyPayload = errors.New("no payload in legacy protocol")
+)
+
+// Encode v as the payload of this subtask.
+func (s *Subtask) SetPayload(v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Version = ProtocolVersion
+	s.Payload = raw
+	return nil
+}
+
+func (s *Subtask) DecodePayload(v interface{}) error {
+	if s.Version == 0 {
+		return ErrLegacyPayload
+	}
+	return json.Unmarshal(s.Payload, v)
+}
+
+// Time left until the deadline, to be sent along with the subtask. Called by the server.
+func (s *Subtask) SetTTL() {
+	s.TTLMs = 0
+	if s.Deadline.IsZero() {
+		return
+	}
+	if s.TTLMs = int64(s.Deadline.Sub(time.Now()) / time.Millisecond); s.TTLMs <= 0 {
+		// Already expired, but zero would mean no deadline.
+		s.TTLMs = -1
+	}
+}
+
+// Move the deadline to this machine's clock by TTLMs, so that clocks out of sync with
+// the server do not matter. Called by satellites as soon as they get the subtask.
+// Subtasks of legacy servers, without TTLMs, keep their deadlines.
+func (s *Subtask) Localize() {
+	if s.TTLMs != 0 {
+		s.Deadline = time.Now().Add(time.Duration(s.TTLMs) * time.Millisecond)
+	}
+}
+
+// Whether the deadline of this subtask has passed.
+func (s *Subtask) Expired() bool {
+	return !s.Deadline.IsZero() && time.Now().After(s.Deadline)
+}
+
+// Derive a context from parent that is done once the deadline passes.
+func (s *Subtask) WithDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.Deadline.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, s.Deadline)
+}
+
+// A successful result with v as its payload.
+func NewResult(v interface{}) *SubtaskResult {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return FailedResult(StatusFailed, CodeBadPayload, err.Error())
+	}
+	return &SubtaskResult{
+		Version: ProtocolVersion,
+		Status:  StatusOK,
+		Payload: raw,
+	}
+}
+
+func FailedResult(status ResultStatus, code string, message string) *SubtaskResult {
+	return &SubtaskResult{
+		Version: ProtocolVersion,
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Legacy results only carry Data.
+func (r *SubtaskResult) Legacy() bool {
+	return r.Version == 0
+}
+
+func (r *SubtaskResult) DecodePayload(v interface{}) error {
+	if r.Legacy() {
+		return ErrLegacyPayload
+	}
+	return json.Unmarshal(r.Payload, v)
+}
@@ -0,0 +1,118 @@
+package dispatcher_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+type testPayload struct {
+	Name string `json:"name"`
+}
+
+func TestProtocolRoundTrip(t *testing.T) {
+	var sb dispatcher.Subtask
+	err := sb.SetPayload(&testPayload{Name: "marisa"})
+	if err != nil {
+		t.Fatalf("Error setting payload: %s", err.Error())
+	}
+
+	raw, err := json.Marshal(&sb)
+	if err != nil {
+		t.Fatalf("Error marshalling subtask: %s", err.Error())
+	}
+	var decoded dispatcher.Subtask
+	err = json.Unmarshal(raw, &decoded)
+	if err != nil {
+		t.Fatalf("Error unmarshalling subtask: %s", err.Error())
+	}
+	if decoded.Version != dispatcher.ProtocolVersion {
+		t.Fatalf("Wrong protocol version: %d", decoded.Version)
+	}
+	var p testPayload
+	err = decoded.DecodePayload(&p)
+	if err != nil || p.Name != "marisa" {
+		t.Fatalf("Wrong payload: %v, %v", p, err)
+	}
+
+	res := dispatcher.NewResult(&testPayload{Name: "alice"})
+	if res.Legacy() || res.Status != dispatcher.StatusOK {
+		t.Fatalf("Wrong result header: %v", res)
+	}
+	err = res.DecodePayload(&p)
+	if err != nil || p.Name != "alice" {
+		t.Fatalf("Wrong result payload: %v, %v", p, err)
+	}
+}
+
+func TestProtocolLegacy(t *testing.T) {
+	// What a legacy satellite sends back.
+	var res dispatcher.SubtaskResult
+	err := json.Unmarshal([]byte(`{"data":["succeeded","JSESSIONID"]}`), &res)
+	if err != nil {
+		t.Fatalf("Error unmarshalling legacy result: %s", err.Error())
+	}
+	if !res.Legacy() {
+		t.Fatalf("Legacy result is not recognized.")
+	}
+	if err = res.DecodePayload(&testPayload{}); err != dispatcher.ErrLegacyPayload {
+		t.Fatalf("Decoding legacy payload should fail, got %v", err)
+	}
+}
+
+func TestSubtaskTypeJSON(t *testing.T) {
+	for _, tp := range []dispatcher.SubtaskType{dispatcher.SubtaskLogin, dispatcher.SubtaskElect, "keep_alive"} {
+		raw, err := json.Marshal(tp)
+		if err != nil {
+			t.Fatalf("Error marshalling %s: %s", tp, err.Error())
+		}
+		var decoded dispatcher.SubtaskType
+		err = json.Unmarshal(raw, &decoded)
+		if err != nil || decoded != tp {
+			t.Fatalf("Wrong subtask type %s (%s): %v", decoded, string(raw), err)
+		}
+	}
+
+	// Legacy satellites only know numeric codes.
+	raw, _ := json.Marshal(dispatcher.SubtaskElect)
+	if string(raw) != "2" {
+		t.Fatalf("Elect is encoded as %s", string(raw))
+	}
+}
+
+func TestSubtaskTTL(t *testing.T) {
+	// A server whose clock is an hour ahead.
+	sent := dispatcher.Subtask{Deadline: time.Now().Add(time.Hour + 5*time.Second)}
+	sent.SetTTL()
+	b, err := json.Marshal(&sent)
+	if err != nil {
+		t.Fatalf("Error marshalling: %s", err.Error())
+	}
+
+	var got dispatcher.Subtask
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Error unmarshalling: %s", err.Error())
+	}
+	got.Localize()
+	if left := time.Until(got.Deadline); left > time.Hour+5*time.Second || left < time.Hour {
+		t.Fatalf("Wrong deadline after localizing: %v left", left)
+	}
+
+	// Already expired on the server.
+	sent = dispatcher.Subtask{Deadline: time.Now().Add(-time.Second)}
+	sent.SetTTL()
+	sent.Localize()
+	if !sent.Expired() {
+		t.Fatalf("Expired subtask should stay expired")
+	}
+
+	// No deadline at all.
+	sent = dispatcher.Subtask{}
+	sent.SetTTL()
+	sent.Localize()
+	if sent.TTLMs != 0 || !sent.Deadline.IsZero() || sent.Expired() {
+		t.Fatalf("Subtask without deadline got one: %+v", sent)
+	}
+}
@@ -3,13 +3,9 @@ package satellite
 import (
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
-	"errors"
 	"flag"
 	"io/ioutil"
-	"os"
 	"sync"
 
 	"github.com/applepi-icpc/icarus/dispatcher"
@@ -18,9 +14,10 @@ import (
 /*
  Server would hold a private key and each satellite would have its corresponding public key.
 
- 1. Satellite generates a random key, then encrypts it with public key and sends it along with the task request. (`TaskRequest`)
+ 1. Satellite generates a random key, then encrypts it with public key and sends it along with the task request,
+    together with the ID of the public key. (`TaskRequest`)
 
- 2. Server decrypts the cipher in the task request with its private key, then encrypts the subtask (a json string) with the random key the satellite first generated and sends it back. (`TaskResponse`)
+ 2. Server decrypts the cipher in the task request with its private key of the ID, then encrypts the subtask (a json string) with the random key the satellite first generated and sends it back. (`TaskResponse`)
 
  3. Satellite do the actual work, and sent back the result encrypted in the same cipher. (`WorkResponse`)
 
@@ -39,10 +36,12 @@ import (
 var (
 	flagPublicKey = flag.String("pub", "public.pem", "Path of public key")
 
-	genkeyOnce sync.Once
-	publicKey  *rsa.PublicKey
+	genkeyOnce   sync.Once
+	publicKey    *rsa.PublicKey
+	publicKeyID  string
+	publicKeyErr error
 
-	ErrNoPublicKeyFound = errors.New("no public key found")
+	ErrNoPublicKeyFound = dispatcher.ErrNoKeyFound
 )
 
 func checkErr(err error) {
@@ -51,25 +50,36 @@ func checkErr(err error) {
 	}
 }
 
-// This function could be called any times you want, explicitly or implicitly.
-func InitPubkey() {
+func loadPubkey() {
 	genkeyOnce.Do(func() {
-		f, err := os.Open(*flagPublicKey)
-		checkErr(err)
-		defer f.Close()
+		data, err := ioutil.ReadFile(*flagPublicKey)
+		if err != nil {
+			publicKeyErr = err
+			return
+		}
+		publicKey, publicKeyErr = dispatcher.ParsePublicKey(data)
+		if publicKeyErr == nil {
+			publicKeyID = dispatcher.KeyID(publicKey)
+		}
+	})
+}
 
-		data, err := ioutil.ReadAll(f)
-		checkErr(err)
+// This function could be called any times you want, explicitly or implicitly.
+func InitPubkey() {
+	loadPubkey()
+	checkErr(publicKeyErr)
+}
 
-		block, _ := pem.Decode(data)
-		if block == nil {
-			panic(ErrNoPublicKeyFound)
-		}
+// Why the public key given by `-pub` could not be loaded, if it could not.
+func PubkeyError() error {
+	loadPubkey()
+	return publicKeyErr
+}
 
-		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
-		checkErr(err)
-		publicKey = pub.(*rsa.PublicKey)
-	})
+// ID of the public key, telling the server which private key to decrypt with.
+func KeyID() string {
+	InitPubkey()
+	return publicKeyID
 }
 
 const (
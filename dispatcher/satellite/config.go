@@ -0,0 +1,200 @@
+package satellite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// The server holds the configuration of satellites (see `dispatcher.ConfigProfiles`).
+// Satellites fetch it at startup with `FetchConfig`, and get it again in the response
+// to any poll once it changes. Fields it leaves unset keep what was given by flags.
+
+// Call f with each configuration the server gives, before its version is told to the server.
+func (p *PostOffice) SetConfigHandler(f func(profile *dispatcher.SatelliteProfile)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.onConfig = f
+}
+
+// Version of the configuration running. Empty if there is none yet.
+func (p *PostOffice) ConfigVersion() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.config.Version
+}
+
+// Capabilities of handlers enabled by the configuration.
+func (p *PostOffice) enabledCapabilities() []dispatcher.Capability {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res := make([]dispatcher.Capability, 0, len(p.capabilities))
+	for _, c := range p.capabilities {
+		if p.config.Config.Enables(c.Handler) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+func (p *PostOffice) configure(profile *dispatcher.SatelliteProfile) {
+	p.mu.Lock()
+	f := p.onConfig
+	p.mu.Unlock()
+
+	if f != nil {
+		f(profile)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config.Version != profile.Version {
+		log.Infof("PostOffice: running config %s", profile.Version)
+	}
+	p.config = *profile
+}
+
+// Fetch the configuration of this satellite from the server, and apply it.
+func (p *PostOffice) FetchConfig(ctx context.Context) error {
+	orig, cipher := GenKey()
+	request := dispatcher.ConfigRequest{
+		Satellite: p.name,
+		Labels:    p.labels,
+		Cipher:    cipher,
+		KeyID:     KeyID(),
+	}
+	requestBody, err := json.Marshal(request)
+	checkErr(err)
+
+	sv, err := p.servers.pick(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/get_config", sv.root), bytes.NewBuffer(requestBody))
+	checkErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.servers.failed(sv, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(b))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			p.servers.failed(sv, err)
+		}
+		return err
+	}
+	p.servers.succeeded(sv)
+
+	var response dispatcher.ConfigResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+	profile, err := decryptProfile(response.Content, orig)
+	if err != nil {
+		return err
+	}
+	p.configure(profile)
+	return nil
+}
+
+// Profiles are encrypted with the key sent along with the request, see `dispatcher.ConfigResponse`.
+func decryptProfile(content string, key []byte) (*dispatcher.SatelliteProfile, error) {
+	raw, err := Decrypt(content, key)
+	if err != nil {
+		return nil, err
+	}
+	var profile dispatcher.SatelliteProfile
+	if err := json.Unmarshal([]byte(raw), &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// Apply the configuration the server gives over what flags gave.
+func (s *Satellite) applyConfig(profile *dispatcher.SatelliteProfile) {
+	c := profile.Config
+
+	level := s.baseLevel
+	if c.LogLevel != "" {
+		if l, err := log.ParseLevel(c.LogLevel); err != nil {
+			log.Warnf("Satellite: invalid log level %q in config %s", c.LogLevel, profile.Version)
+		} else {
+			level = l
+		}
+	}
+	log.SetLevel(level)
+
+	proxies := client.DefaultProxies()
+	if c.Proxies != nil {
+		proxies = *c.Proxies
+	}
+	s.mu.Lock()
+	changed := proxies != s.proxies
+	s.mu.Unlock()
+	if changed {
+		if err := client.SetProxies(proxies); err != nil {
+			log.Warnf("Satellite: invalid proxies in config %s: %s", profile.Version, err.Error())
+		} else {
+			s.mu.Lock()
+			s.proxies = proxies
+			s.mu.Unlock()
+		}
+	}
+
+	s.mu.Lock()
+	s.config = c
+	s.reconfigureLocked()
+	more := 0
+	if s.baseMax > 0 {
+		// Running already.
+		more = s.min - s.routines
+	}
+	s.mu.Unlock()
+	if more > 0 {
+		s.grow(more)
+	}
+}
+
+// Work out delay and bounds of routines from flags and the configuration.
+// Called with s.mu held.
+func (s *Satellite) reconfigureLocked() {
+	c := s.config
+	s.delay = s.baseDelay
+	if c.DelayMs != nil {
+		s.delay = time.Duration(*c.DelayMs) * time.Millisecond
+	}
+	s.min, s.max = s.baseMin, s.baseMax
+	if c.MinRoutines != nil {
+		s.min = *c.MinRoutines
+	}
+	if c.MaxRoutines != nil {
+		s.max = *c.MaxRoutines
+	}
+	if s.min < 1 {
+		s.min = 1
+	}
+	if s.max < s.min {
+		s.max = s.min
+	}
+}
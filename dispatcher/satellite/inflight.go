@@ -0,0 +1,41 @@
+package satellite
+
+import (
+	"context"
+	"sync"
+)
+
+// Subtasks being worked on by this satellite, so that they could be aborted
+// when the server tells they have been cancelled.
+var (
+	inflightMu sync.Mutex
+	inflight   = make(map[int64]context.CancelFunc)
+)
+
+// Returns a context that is cancelled once the server cancels the subtask.
+// Call the returned function when the subtask is done.
+func track(parent context.Context, id int64) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+
+	inflightMu.Lock()
+	inflight[id] = cancel
+	inflightMu.Unlock()
+
+	return ctx, func() {
+		inflightMu.Lock()
+		delete(inflight, id)
+		inflightMu.Unlock()
+		cancel()
+	}
+}
+
+func revoke(ids []int64) {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+
+	for _, id := range ids {
+		if cancel, ok := inflight[id]; ok {
+			cancel()
+		}
+	}
+}
@@ -2,105 +2,267 @@ package satellite
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/applepi-icpc/icarus/client"
 	"github.com/applepi-icpc/icarus/dispatcher"
 )
 
+var (
+	flagName   = flag.String("name", "", "Name of this satellite (default: hostname-pid)")
+	flagLabels = flag.String("labels", "", "Labels of this satellite, e.g. network=campus,isp=cernet")
+
+	nameOnce sync.Once
+	name     string
+
+	labelsOnce sync.Once
+	labels     dispatcher.Labels
+)
+
+// Name of this satellite, told to the server on every request.
+func Name() string {
+	nameOnce.Do(func() {
+		name = *flagName
+		if name == "" {
+			host, err := os.Hostname()
+			if err != nil {
+				host = "satellite"
+			}
+			name = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+	})
+	return name
+}
+
+// Labels of this satellite, told to the server on every request.
+func Labels() dispatcher.Labels {
+	labelsOnce.Do(func() {
+		var err error
+		labels, err = dispatcher.ParseLabels(*flagLabels)
+		if err != nil {
+			log.Fatalf("Invalid labels %q: %s", *flagLabels, err.Error())
+		}
+		labels = withWorkerKeys(labels)
+	})
+	return labels
+}
+
+// Subtasks carrying credentials sealed to a worker key come to those holding it,
+// so worker key labels are those of keys held, whatever is given.
+func withWorkerKeys(labels dispatcher.Labels) dispatcher.Labels {
+	labels, stripped := dispatcher.WithoutWorkerKeys(labels)
+	if stripped {
+		log.Warnf("Satellite: worker key labels given are ignored, they come from worker keys held")
+	}
+	return dispatcher.MergeLabels(client.WorkerKeyLabels(), labels)
+}
+
 type PostOffice struct {
-	root              string
-	avaliableHandlers []string
+	servers      *serverPool
+	name         string
+	labels       dispatcher.Labels
+	capabilities []dispatcher.Capability
+
+	mu       sync.Mutex
+	refused  map[string]bool
+	config   dispatcher.SatelliteProfile // See config.go
+	onConfig func(profile *dispatcher.SatelliteProfile)
 }
 
-func NewPostOffice(root string, avaliableHandlers []string) *PostOffice {
+// root is the URL of the server, or a comma separated list of them, each optionally
+// followed by "=weight", e.g. "http://a:8001,http://b:8001=2". See `PolicyFailover` and `PolicyRoundRobin`.
+func NewPostOffice(root string, capabilities []dispatcher.Capability) *PostOffice {
 	return &PostOffice{
-		root:              root,
-		avaliableHandlers: avaliableHandlers,
+		servers:      newServerPool(root),
+		name:         Name(),
+		labels:       Labels(),
+		capabilities: capabilities,
+		refused:      make(map[string]bool),
+	}
+}
+
+// Tell the server another name than `Name()`, e.g. to run several satellites in one process.
+func (p *PostOffice) SetName(name string) {
+	p.name = name
+}
+
+// Tell the server other labels than `Labels()`. Worker key labels are still those of keys held.
+func (p *PostOffice) SetLabels(labels dispatcher.Labels) {
+	p.labels = withWorkerKeys(labels)
+}
+
+// Use another policy than the one given by `-server-policy`.
+func (p *PostOffice) SetPolicy(policy string) error {
+	return p.servers.setPolicy(policy)
+}
+
+// Back off and retry otherwise than the package variables tell.
+func (p *PostOffice) SetRetry(retry Retry) {
+	p.servers.setRetry(retry)
+}
+
+// Health of the servers, in the order given.
+func (p *PostOffice) Servers() []ServerStatus {
+	return p.servers.status()
+}
+
+// Warn once for each operation the server refused to give.
+func (p *PostOffice) noteRefused(refused []dispatcher.Refusal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, r := range refused {
+		key := fmt.Sprintf("%s/%s", r.Handler, r.Operation)
+		if p.refused[key] {
+			continue
+		}
+		p.refused[key] = true
+		log.Warnf("GetTask: Server refused %s: worker version %d is older than %d, please upgrade", key, r.WorkerVersion, r.MinVersion)
 	}
 }
 
 // Handles a specific subtask
 type Postman struct {
 	office  *PostOffice
+	server  *server // Who issued the subtask, and takes its result.
 	key     []byte
 	Subtask *dispatcher.Subtask
 }
 
 var (
-	ErrNoNewTasks   = errors.New("no new tasks")
-	ErrTaskVanished = errors.New("task vanished")
+	ErrNoNewTasks    = errors.New("no new tasks")
+	ErrTaskVanished  = errors.New("task vanished")
+	ErrTaskCancelled = errors.New("task cancelled")
+	ErrTaskExpired   = errors.New("task expired")
 )
 
 func (p *PostOffice) GetTask() (*Postman, error) {
+	return p.GetTaskContext(context.Background())
+}
+
+// Same as `GetTask`, but gives up polling once ctx is done.
+func (p *PostOffice) GetTaskContext(ctx context.Context) (*Postman, error) {
+	pm, _, err := p.Poll(ctx)
+	return pm, err
+}
+
+// Same as `GetTaskContext`, but also returns the backlog hinted by the server, if any.
+func (p *PostOffice) Poll(ctx context.Context) (*Postman, *dispatcher.Backlog, error) {
 	orig, cipher := GenKey()
+	caps := p.enabledCapabilities()
+	accepts := make([]string, 0, len(caps))
+	for _, c := range caps {
+		accepts = append(accepts, c.Handler)
+	}
 	request := dispatcher.TaskRequest{
-		Accepts: strings.Join(p.avaliableHandlers, ","),
-		Cipher:  cipher,
+		Satellite:     p.name,
+		Labels:        p.labels,
+		Accepts:       strings.Join(accepts, ","),
+		Capabilities:  caps,
+		Cipher:        cipher,
+		KeyID:         KeyID(),
+		ConfigVersion: p.ConfigVersion(),
 	}
 	requestBody, err := json.Marshal(request)
 	checkErr(err)
 
-	resp, err := http.Post(fmt.Sprintf("%s/get_task", p.root),
-		"application/json",
-		bytes.NewBuffer(requestBody),
-	)
+	sv, err := p.servers.pick(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/get_task", sv.root), bytes.NewBuffer(requestBody))
+	checkErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
 		log.Warnf("GetTask: Failed to make get task request: %s", err.Error())
-		return nil, err
+		p.servers.failed(sv, err)
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		b, _ := ioutil.ReadAll(resp.Body)
 		log.Warnf("GetTask: Server: HTTP %d: %s", resp.StatusCode, string(b))
-		return nil, errors.New(string(b))
+		err = errors.New(string(b))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			p.servers.failed(sv, err)
+		}
+		return nil, nil, err
 	}
+	p.servers.succeeded(sv)
 
 	var response dispatcher.TaskResponse
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
 		log.Warnf("GetTask: Failed to decode server's response: %s", err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 
+	p.noteRefused(response.Refused)
+	revoke(response.Cancelled)
+	if response.Config != "" {
+		if profile, err := decryptProfile(response.Config, orig); err != nil {
+			log.Warnf("GetTask: Failed to decrypt config: %s", err.Error())
+		} else {
+			p.configure(profile)
+		}
+	}
 	if !response.OK {
-		return nil, ErrNoNewTasks
+		return nil, response.Backlog, ErrNoNewTasks
 	}
 
 	content, err := Decrypt(response.Content, orig)
 	if err != nil {
 		log.Warnf("GetTask: Failed to decrypt server's response: %s", err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 	var sb dispatcher.Subtask
 	err = json.Unmarshal([]byte(content), &sb)
 	if err != nil {
 		log.Warnf("GetTask: Failed to decode server's content: %s", err.Error())
-		return nil, err
+		return nil, nil, err
 	}
+	sb.Localize()
 
 	return &Postman{
 		office:  p,
+		server:  sv,
 		key:     orig,
 		Subtask: &sb,
-	}, nil
+	}, response.Backlog, nil
 }
 
 func (pm *Postman) SendResult(res *dispatcher.SubtaskResult) error {
+	_, err := pm.sendResult(context.Background(), res)
+	return err
+}
+
+// Also tells whether it is worth trying again, i.e. the server could not be reached or failed.
+// Gives up after the result timeout, or once the deadline of the subtask passes, as nobody waits for it then.
+func (pm *Postman) sendResult(ctx context.Context, res *dispatcher.SubtaskResult) (bool, error) {
 	rawContent, err := json.Marshal(res)
 	if err != nil {
-		return err
+		return false, err
 	}
 	content, err := NakedEncrypt(string(rawContent), pm.key)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	wr := dispatcher.WorkResponse{
@@ -110,24 +272,73 @@ func (pm *Postman) SendResult(res *dispatcher.SubtaskResult) error {
 	requestBody, err := json.Marshal(wr)
 	checkErr(err)
 
-	resp, err := http.Post(fmt.Sprintf("%s/put_result", pm.office.root),
-		"application/json",
-		bytes.NewBuffer(requestBody),
-	)
+	// Only the server that issued the subtask knows its key.
+	servers := pm.office.servers
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, servers.getRetry().ResultTimeout)
+	defer cancel()
+	if deadline := pm.Subtask.Deadline; !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/put_result", pm.server.root), bytes.NewBuffer(requestBody))
+	checkErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
+		if parent.Err() != nil {
+			// Aborted by the caller, e.g. on shutdown. The server is not to blame.
+			return false, parent.Err()
+		}
 		log.Warnf("SendResult: Failed to make send result request: %s", err.Error())
-		return err
+		servers.failed(pm.server, err)
+		return true, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		servers.failed(pm.server, fmt.Errorf("HTTP %d", resp.StatusCode))
+	} else {
+		servers.succeeded(pm.server)
+	}
 
 	if resp.StatusCode == http.StatusGone {
 		log.Warnf("SendResult: Task vanished.")
-		return ErrTaskVanished
+		return false, ErrTaskVanished
+	} else if resp.StatusCode == http.StatusConflict {
+		return false, ErrTaskCancelled
 	} else if resp.StatusCode != http.StatusOK {
 		b, _ := ioutil.ReadAll(resp.Body)
 		log.Warnf("SendResult: Server: HTTP %d: %s", resp.StatusCode, string(b))
-		return errors.New(string(b))
+		return resp.StatusCode >= http.StatusInternalServerError, errors.New(string(b))
 	} else {
-		return nil
+		return false, nil
+	}
+}
+
+// Send the result back, and try again with back-off if the server could not be reached
+// or failed, until the deadline of the subtask passes or ctx is done.
+// A result lost is a course elected that the task keeps trying to elect.
+func (pm *Postman) DeliverResult(ctx context.Context, res *dispatcher.SubtaskResult) error {
+	policy := pm.office.servers.getRetry()
+	wait := policy.ResultRetryBase
+	for {
+		retry, err := pm.sendResult(ctx, res)
+		if !retry {
+			return err
+		}
+		deadline := pm.Subtask.Deadline
+		if deadline.IsZero() || time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		log.Warnf("SendResult: Retrying task %d in %s", pm.Subtask.ID, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
+		if wait > policy.ResultRetryMax {
+			wait = policy.ResultRetryMax
+		}
 	}
 }
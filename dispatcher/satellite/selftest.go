@@ -0,0 +1,140 @@
+package satellite
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// How long each check of `SelfTest` could take.
+var SelfTestTimeout = 30 * time.Second
+
+var (
+	ErrHandshakeFailed = errors.New("server does not hold the private key of the public key")
+)
+
+type CheckResult struct {
+	Name string
+	Err  error // Nil if passed
+	Took time.Duration
+}
+
+// Tell the server a random key and a challenge, and see whether it sends the challenge
+// back encrypted with the key, i.e. whether it could decrypt what this satellite sends.
+func (p *PostOffice) handshake(ctx context.Context, sv *server) error {
+	if err := PubkeyError(); err != nil {
+		return fmt.Errorf("no public key: %s", err.Error())
+	}
+	orig, cipher := GenKey()
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	checkErr(err)
+	challenge := base64.StdEncoding.EncodeToString(b)
+
+	requestBody, err := json.Marshal(dispatcher.HandshakeRequest{
+		Satellite: p.name,
+		Cipher:    cipher,
+		KeyID:     KeyID(),
+		Challenge: challenge,
+	})
+	checkErr(err)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/handshake", sv.root), bytes.NewBuffer(requestBody))
+	checkErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.New("server is too old to shake hands")
+	} else if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(b))
+	}
+	var response dispatcher.HandshakeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+	if content, err := Decrypt(response.Content, orig); err != nil || content != challenge {
+		return ErrHandshakeFailed
+	}
+	if response.ProtocolVersion != dispatcher.ProtocolVersion {
+		return fmt.Errorf("server speaks protocol version %d rather than %d", response.ProtocolVersion, dispatcher.ProtocolVersion)
+	}
+	return nil
+}
+
+// Run f with a timeout, failing it if it panics.
+func runCheck(name string, f func(ctx context.Context) error) (res CheckResult) {
+	res.Name = name
+	start := time.Now()
+	defer func() {
+		if v := recover(); v != nil {
+			res.Err = fmt.Errorf("panic: %v", v)
+		}
+		res.Took = time.Since(start)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), SelfTestTimeout)
+	defer cancel()
+	res.Err = f(ctx)
+	return
+}
+
+// Check what this satellite needs before it takes any subtask: the public key loads,
+// every server shakes hands, checks handles registered pass (see `client.RegisterCheck`),
+// and every worker answers a dry probe (see `client.Prober`).
+func (p *PostOffice) SelfTest() []CheckResult {
+	res := []CheckResult{
+		runCheck("public key", func(ctx context.Context) error {
+			return PubkeyError()
+		}),
+	}
+	for _, sv := range p.servers.servers {
+		sv := sv
+		res = append(res, runCheck(fmt.Sprintf("server %s", sv.root), func(ctx context.Context) error {
+			return p.handshake(ctx, sv)
+		}))
+	}
+	for _, c := range client.Checks() {
+		res = append(res, runCheck(c.Name, c.Run))
+	}
+	workers := client.RegisteredWorkerList()
+	sort.Strings(workers)
+	for _, h := range workers {
+		h := h
+		res = append(res, runCheck(fmt.Sprintf("worker %s", h), func(ctx context.Context) error {
+			return client.ProbeWorker(ctx, h)
+		}))
+	}
+	return res
+}
+
+// Print one line for each check, and return whether all of them passed.
+func WriteReport(w io.Writer, results []CheckResult) bool {
+	passed := 0
+	for _, r := range results {
+		if r.Err == nil {
+			passed++
+			fmt.Fprintf(w, "PASS  %-32s %s\n", r.Name, r.Took.Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(w, "FAIL  %-32s %s: %s\n", r.Name, r.Took.Round(time.Millisecond), r.Err.Error())
+		}
+	}
+	fmt.Fprintf(w, "%d of %d checks passed\n", passed, len(results))
+	return passed == len(results)
+}
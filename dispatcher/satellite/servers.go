@@ -0,0 +1,244 @@
+package satellite
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How a PostOffice picks among its servers.
+const (
+	// The first server in the list that is not backing off.
+	PolicyFailover = "failover"
+	// Servers not backing off take turns, in proportion to their weights.
+	PolicyRoundRobin = "round-robin"
+)
+
+var (
+	flagPolicy = flag.String("server-policy", PolicyFailover, "How to pick among servers: failover or round-robin")
+
+	// How long a server is left alone after its first connection error.
+	// It doubles with each error in a row, up to BackOffMax.
+	BackOffBase = time.Second
+	BackOffMax  = time.Minute
+
+	// How long before sending a result again, after the server could not be reached or failed.
+	// It doubles with each try, up to ResultRetryMax. Results are not sent after the deadline.
+	ResultRetryBase = 500 * time.Millisecond
+	ResultRetryMax  = 10 * time.Second
+
+	// How long one try of sending a result could take, at most until the deadline of the subtask.
+	ResultTimeout = 10 * time.Second
+)
+
+// How a PostOffice backs off and retries, see the package variables of the same names.
+type Retry struct {
+	BackOffBase     time.Duration
+	BackOffMax      time.Duration
+	ResultRetryBase time.Duration
+	ResultRetryMax  time.Duration
+	ResultTimeout   time.Duration
+}
+
+// Retry given by the package variables.
+func DefaultRetry() Retry {
+	return Retry{
+		BackOffBase:     BackOffBase,
+		BackOffMax:      BackOffMax,
+		ResultRetryBase: ResultRetryBase,
+		ResultRetryMax:  ResultRetryMax,
+		ResultTimeout:   ResultTimeout,
+	}
+}
+
+var (
+	ErrInvalidServers = errors.New("invalid server list")
+	ErrInvalidPolicy  = errors.New("invalid server policy")
+)
+
+type ServerStatus struct {
+	Root     string    `json:"root"`
+	Weight   int       `json:"weight"`
+	Failures int       `json:"failures"` // Connection errors in a row
+	RetryAt  time.Time `json:"retry_at"` // Left alone until
+	LastOK   time.Time `json:"last_ok"`
+}
+
+type server struct {
+	root     string
+	weight   int
+	current  int // For smooth weighted round-robin
+	failures int
+	retryAt  time.Time
+	lastOK   time.Time
+}
+
+// Parse "http://a:8001,http://b:8001=2" into servers. Weights default to 1.
+func parseServers(s string) ([]*server, error) {
+	res := make([]*server, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		sv := &server{
+			root:   v,
+			weight: 1,
+		}
+		if i := strings.LastIndex(v, "="); i >= 0 {
+			w, err := strconv.Atoi(v[i+1:])
+			if err != nil || w <= 0 {
+				return nil, ErrInvalidServers
+			}
+			sv.root = v[:i]
+			sv.weight = w
+		}
+		sv.root = strings.TrimRight(sv.root, "/")
+		res = append(res, sv)
+	}
+	if len(res) == 0 {
+		return nil, ErrInvalidServers
+	}
+	return res, nil
+}
+
+type serverPool struct {
+	mu      sync.Mutex
+	policy  string
+	retry   Retry
+	servers []*server
+}
+
+func newServerPool(roots string) *serverPool {
+	servers, err := parseServers(roots)
+	if err != nil {
+		log.Fatalf("Invalid servers %q: %s", roots, err.Error())
+	}
+	pool := &serverPool{
+		retry:   DefaultRetry(),
+		servers: servers,
+	}
+	if err := pool.setPolicy(*flagPolicy); err != nil {
+		log.Fatalf("Invalid server policy %q: %s", *flagPolicy, err.Error())
+	}
+	return pool
+}
+
+func (sp *serverPool) setPolicy(policy string) error {
+	if policy != PolicyFailover && policy != PolicyRoundRobin {
+		return ErrInvalidPolicy
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.policy = policy
+	return nil
+}
+
+func (sp *serverPool) setRetry(retry Retry) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.retry = retry
+}
+
+func (sp *serverPool) getRetry() Retry {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return sp.retry
+}
+
+// The server to poll next. If all are backing off, waits for the first to come back, or ctx to be done.
+func (sp *serverPool) pick(ctx context.Context) (*server, error) {
+	for {
+		sp.mu.Lock()
+		now := time.Now()
+		var best *server
+		total := 0
+		wait := sp.retry.BackOffMax
+		for _, sv := range sp.servers {
+			if now.Before(sv.retryAt) {
+				if d := sv.retryAt.Sub(now); d < wait {
+					wait = d
+				}
+				continue
+			}
+			if sp.policy == PolicyFailover {
+				best = sv
+				break
+			}
+			// Smooth weighted round-robin, as nginx does.
+			sv.current += sv.weight
+			total += sv.weight
+			if best == nil || sv.current > best.current {
+				best = sv
+			}
+		}
+		if best != nil {
+			best.current -= total
+			sp.mu.Unlock()
+			return best, nil
+		}
+		sp.mu.Unlock()
+
+		log.Warnf("PostOffice: all servers are down, retrying in %s", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Record a connection error, or a server error, of sv.
+func (sp *serverPool) failed(sv *server, err error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sv.failures++
+	d := sp.retry.BackOffBase
+	for i := 1; i < sv.failures && d < sp.retry.BackOffMax; i++ {
+		d *= 2
+	}
+	if d > sp.retry.BackOffMax {
+		d = sp.retry.BackOffMax
+	}
+	sv.retryAt = time.Now().Add(d)
+	log.Warnf("PostOffice: server %s failed (%s), backing off for %s", sv.root, err.Error(), d)
+}
+
+func (sp *serverPool) succeeded(sv *server) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sv.failures > 0 {
+		log.Infof("PostOffice: server %s is back", sv.root)
+	}
+	sv.failures = 0
+	sv.retryAt = time.Time{}
+	sv.lastOK = time.Now()
+}
+
+func (sp *serverPool) status() []ServerStatus {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	res := make([]ServerStatus, len(sp.servers))
+	for i, sv := range sp.servers {
+		res[i] = ServerStatus{
+			Root:     sv.root,
+			Weight:   sv.weight,
+			Failures: sv.failures,
+			RetryAt:  sv.retryAt,
+			LastOK:   sv.lastOK,
+		}
+	}
+	return res
+}
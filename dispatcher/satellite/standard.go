@@ -1,68 +1,357 @@
 package satellite
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/applepi-icpc/icarus/client"
 	"github.com/applepi-icpc/icarus/dispatcher"
+	"github.com/applepi-icpc/icarus/trace"
 )
 
 var SilentSatellite = false
 
+var (
+	ErrShutdown      = errors.New("satellite shut down")
+	ErrWorkerCrashed = errors.New("worker crashed")
+)
+
+// Satellite runs routines pulling and running subtasks, until it is shut down.
+// The number of routines is scaled between bounds by the backlog the server hints:
+// one more for each subtask waiting, and one less for each poll getting nothing.
+type Satellite struct {
+	office  *PostOffice
+	started time.Time
+
+	// Given by flags, see `applyConfig`.
+	baseDelay time.Duration
+	baseMin   int
+	baseMax   int
+	baseLevel log.Level
+
+	mu       sync.Mutex
+	config   dispatcher.SatelliteConfig
+	proxies  string // Egress proxies in use, in the form of `-proxies`.
+	delay    time.Duration
+	min      int
+	max      int
+	routines int
+	running  map[int64]InFlight
+	outcomes map[dispatcher.SubtaskType][]string // Most recent last
+	shutdown bool                                // No routines are started once set, so wg.Add never races wg.Wait.
+
+	// Cancelled once shutting down, to stop pulling.
+	pulling  context.Context
+	stopPull context.CancelFunc
+	// Cancelled once the grace period is over, to abort subtasks in flight.
+	working   context.Context
+	abortWork context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func NewSatellite(root string, delay time.Duration) *Satellite {
+	s := &Satellite{
+		office:    NewPostOffice(root, client.WorkerCapabilities()),
+		started:   time.Now(),
+		baseDelay: delay,
+		baseLevel: log.GetLevel(),
+		proxies:   client.DefaultProxies(),
+		delay:     delay,
+		running:   make(map[int64]InFlight),
+		outcomes:  make(map[dispatcher.SubtaskType][]string),
+	}
+	s.office.SetConfigHandler(s.applyConfig)
+	s.pulling, s.stopPull = context.WithCancel(context.Background())
+	s.working, s.abortWork = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *Satellite) PostOffice() *PostOffice {
+	return s.office
+}
+
+// Routines running now.
+func (s *Satellite) Routines() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.routines
+}
+
+// Run n routines, and return once all of them stop after `Shutdown`.
+func (s *Satellite) Run(n int) {
+	s.RunPool(n, n)
+}
+
+// Run from min up to max routines, and return once all of them stop after `Shutdown`.
+// The configuration the server gives overrides them.
+func (s *Satellite) RunPool(min int, max int) {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	s.mu.Lock()
+	s.baseMin = min
+	s.baseMax = max
+	s.reconfigureLocked()
+	n := s.min
+	s.mu.Unlock()
+
+	s.grow(n)
+	s.wg.Wait()
+}
+
+// Start up to n more routines, as long as there are fewer than max.
+func (s *Satellite) grow(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return
+	}
+	started := 0
+	for ; started < n && s.routines < s.max; started++ {
+		s.routines++
+		s.wg.Add(1)
+		go s.routine()
+	}
+	if started > 0 && s.routines > s.min {
+		log.Infof("Satellite: scaled up to %d routines", s.routines)
+	}
+}
+
+// Whether the routine should stop, as there are more than min.
+func (s *Satellite) shrink() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.routines <= s.min {
+		return false
+	}
+	s.routines--
+	log.Infof("Satellite: scaled down to %d routines", s.routines)
+	return true
+}
+
+// Whether the routine should stop, as there are more than max since the configuration changed.
+func (s *Satellite) trim() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.routines <= s.max {
+		return false
+	}
+	s.routines--
+	log.Infof("Satellite: scaled down to %d routines", s.routines)
+	return true
+}
+
+func (s *Satellite) getDelay() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.delay
+}
+
+func (s *Satellite) routine() {
+	defer s.wg.Done()
+	for s.pulling.Err() == nil {
+		if s.trim() {
+			return
+		}
+		b, ok := s.runOne()
+
+		wait := s.getDelay()
+		if b != nil {
+			if b.RetryAfterMs > 0 {
+				wait = time.Duration(b.RetryAfterMs) * time.Millisecond
+			} else if b.QueueDepth > 0 {
+				wait = 0
+				s.grow(b.QueueDepth)
+			} else if d := time.Duration(b.PollIntervalMs) * time.Millisecond; d > wait {
+				wait = d
+			}
+		}
+		if !ok && (b == nil || b.QueueDepth == 0) && s.shrink() {
+			return
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-s.pulling.Done():
+		}
+	}
+	s.mu.Lock()
+	s.routines--
+	s.mu.Unlock()
+}
+
+// Stop pulling, and wait for subtasks in flight, and their results to be sent back,
+// up to grace. Those still running then are aborted.
+// Returns false if the grace period is over before they are done.
+func (s *Satellite) Shutdown(grace time.Duration) bool {
+	log.Infof("Satellite: shutting down, waiting for subtasks in flight for up to %s", grace)
+	s.mu.Lock()
+	s.shutdown = true
+	s.mu.Unlock()
+	s.stopPull()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Infof("Satellite: all subtasks done")
+		return true
+	case <-time.After(grace):
+		log.Warnf("Satellite: grace period is over, aborting subtasks in flight")
+		s.abortWork()
+		return false
+	}
+}
+
+// Pull and run subtasks forever.
 func StandardSatellite(root string, delay time.Duration) {
-	p := NewPostOffice(root, client.RegisteredWorkerList())
-	for {
-		func() {
-			defer time.Sleep(delay)
-
-			pm, err := p.GetTask()
-			if err != nil {
-				if err == ErrNoNewTasks {
-					if !SilentSatellite {
-						log.Infof("No new task avaliable")
-					}
-				} else {
-					log.Warnf("Error fetching new task: %s", err.Error())
+	NewSatellite(root, delay).Run(1)
+}
+
+// Pull a subtask, run it, and send the result back.
+// Returns the backlog hinted by the server, and whether there was a subtask.
+// A panic, of the worker or of the satellite itself, is sent back as `client.CrashedResult`
+// if there is a subtask, so that the routine goes on and the server learns about it.
+func (s *Satellite) runOne() (backlog *dispatcher.Backlog, ok bool) {
+	var pm *Postman
+	var end func(outcome string)
+	defer func() {
+		v := recover()
+		if v != nil {
+			stack := debug.Stack()
+			log.Errorf("Satellite: recovered from panic: %v\n%s", v, stack)
+			ok = true
+			if pm != nil {
+				if err := pm.DeliverResult(s.working, client.CrashedResult(v, stack)); err != nil {
+					log.Warnf("Satellite: error sending back crash of task %d: %s", pm.Subtask.ID, err.Error())
 				}
-				return
 			}
+		}
+		if end != nil {
+			if v != nil {
+				end(OutcomeCrashed)
+			} else {
+				// Every way out notes its outcome.
+				end(OutcomeUnknown)
+			}
+		}
+	}()
 
-			sb := pm.Subtask
+	pm, backlog, err := s.office.Poll(s.pulling)
+	if err != nil {
+		if err == ErrNoNewTasks {
 			if !SilentSatellite {
-				log.Infof("Get task %d: handler %s, task type %d", sb.ID, sb.Handler, int(sb.Type))
+				log.Infof("No new task avaliable")
 			}
+		} else if s.pulling.Err() == nil {
+			log.Warnf("Error fetching new task: %s", err.Error())
+		}
+		return backlog, false
+	}
 
-			w, err := client.GetWorker(sb.Handler)
-			if err != nil {
-				log.Errorf("Unknown handler: %s", sb.Handler)
-				return
-			}
+	sb := pm.Subtask
+	span := trace.StartFrom(sb.Trace, "satellite.subtask")
+	span.SetTag("handler", sb.Handler)
+	span.SetTag("subtask_id", fmt.Sprintf("%d", sb.ID))
+	defer span.Finish()
+	slog := span.Logger()
 
-			var res []string
-			if sb.Type == dispatcher.SubtaskLogin {
-				res = w.Login(sb.Data)
-			} else if sb.Type == dispatcher.SubtaskList {
-				res = w.ListCourse(sb.Data)
-			} else if sb.Type == dispatcher.SubtaskElect {
-				res = w.Elect(sb.Data)
-			} else {
-				log.Errorf("Unknown subtask type: %d", int(sb.Type))
-				return
-			}
+	if !SilentSatellite {
+		slog.Infof("Get task %d: handler %s, task type %s", sb.ID, sb.Handler, sb.Type)
+	}
 
-			resp := &dispatcher.SubtaskResult{
-				Data: res,
-			}
+	end = s.begin(sb)
 
-			err = pm.SendResult(resp)
-			if err == ErrTaskVanished {
-				if !SilentSatellite {
-					log.Warnf("Task %d has gone", sb.ID)
-				}
-			} else if err != nil {
-				log.Warnf("Task %d error sending back result: %s", sb.ID, err.Error())
-			}
-		}()
+	// Nobody is waiting for the result anymore.
+	if sb.Expired() {
+		end(OutcomeExpired)
+		span.SetError(ErrTaskExpired)
+		slog.Warnf("Task %d expired %s ago, skipped", sb.ID, time.Since(sb.Deadline))
+		return backlog, true
+	}
+
+	dctx, cancel := sb.WithDeadline(s.working)
+	defer cancel()
+	ctx, done := track(dctx, sb.ID)
+	defer done()
+
+	var resp *dispatcher.SubtaskResult
+	w, err := client.GetWorker(sb.Handler)
+	if err != nil {
+		span.SetError(err)
+		slog.Errorf("Unknown handler: %s", sb.Handler)
+		resp = client.UnsupportedResult(dispatcher.CodeUnknownHandler,
+			fmt.Sprintf("no worker for handler %s", sb.Handler))
+	} else {
+		wspan := trace.StartFrom(span.Context(), fmt.Sprintf("worker.%s", sb.Type))
+		resp = client.RunSafely(trace.NewContext(ctx, wspan), w, sb)
+		if resp.Code == dispatcher.CodeWorkerCrashed {
+			wspan.SetError(ErrWorkerCrashed)
+			slog.Errorf("Task %d: %s\n%s", sb.ID, resp.Message, resp.Stack)
+		}
+		wspan.SetTag("status", resp.Status.String())
+		wspan.Finish()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		span.SetError(ErrTaskExpired)
+		end(OutcomeExpired)
+		slog.Warnf("Task %d expired while running", sb.ID)
+		return backlog, true
+	} else if s.working.Err() != nil {
+		end(OutcomeAborted)
+		span.SetError(ErrShutdown)
+		slog.Warnf("Task %d aborted on shutdown", sb.ID)
+		return backlog, true
+	} else if ctx.Err() != nil {
+		end(OutcomeCancelled)
+		span.SetError(ErrTaskCancelled)
+		if !SilentSatellite {
+			slog.Warnf("Task %d has been cancelled", sb.ID)
+		}
+		return backlog, true
+	}
+	if resp.Status != dispatcher.StatusOK {
+		slog.Warnf("Task %d: %s", sb.ID, client.NewWorkerError(resp.Status, resp.Code, resp.Message).Error())
+	}
+
+	sspan := trace.StartFrom(span.Context(), "satellite.send_result")
+	err = pm.DeliverResult(s.working, resp)
+	sspan.SetError(err)
+	sspan.Finish()
+	if err == ErrTaskVanished {
+		end(OutcomeVanished)
+		if !SilentSatellite {
+			slog.Warnf("Task %d has gone", sb.ID)
+		}
+	} else if err == ErrTaskCancelled {
+		end(OutcomeCancelled)
+		if !SilentSatellite {
+			slog.Warnf("Task %d has been cancelled", sb.ID)
+		}
+	} else if err != nil {
+		end(OutcomeUndelivered)
+		span.SetError(err)
+		slog.Warnf("Task %d error sending back result: %s", sb.ID, err.Error())
+	} else if resp.Code == dispatcher.CodeWorkerCrashed {
+		end(OutcomeCrashed)
+	} else {
+		end(resp.Status.String())
 	}
+	return backlog, true
 }
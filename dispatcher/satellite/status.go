@@ -0,0 +1,155 @@
+package satellite
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// How many outcomes of each subtask type `Status` counts, the most recent ones.
+var RecentOutcomes = 50
+
+// Outcomes of subtasks besides the status of their results.
+const (
+	OutcomeExpired     = "expired"     // Deadline passed before or while running
+	OutcomeCancelled   = "cancelled"   // Cancelled by the server
+	OutcomeAborted     = "aborted"     // Still running when the grace period was over
+	OutcomeVanished    = "vanished"    // Server forgot the subtask before its result came
+	OutcomeUndelivered = "undelivered" // Result could not be sent back before the deadline
+	OutcomeCrashed     = "crashed"     // Worker panicked, see `client.CrashedResult`
+	OutcomeUnknown     = "unknown"     // Ended without noting how, which should not happen
+)
+
+type InFlight struct {
+	ID      int64                  `json:"id"`
+	Handler string                 `json:"handler"`
+	Type    dispatcher.SubtaskType `json:"type"`
+	Started time.Time              `json:"started"`
+	AgeMs   int64                  `json:"age_ms"`
+}
+
+type Status struct {
+	Name          string            `json:"name"`
+	Labels        dispatcher.Labels `json:"labels"`
+	Started       time.Time         `json:"started"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	ShuttingDown  bool              `json:"shutting_down"`
+	Workers       []string          `json:"workers"`
+	ConfigVersion string            `json:"config_version"` // Empty if the server has given none
+	Routines      int               `json:"routines"`
+	MinRoutines   int               `json:"min_routines"`
+	MaxRoutines   int               `json:"max_routines"`
+	InFlight      []InFlight        `json:"in_flight"` // Oldest first
+
+	// Type -> outcome -> count, over the last `RecentOutcomes` subtasks of the type.
+	// Outcomes are result statuses, e.g. "ok" and "failed", or one of `OutcomeExpired` etc.
+	Outcomes map[dispatcher.SubtaskType]map[string]int `json:"outcomes"`
+
+	// Whether the last request to any server went through.
+	Connected bool                 `json:"connected"`
+	Servers   []ServerStatus       `json:"servers"`
+	Proxies   []client.ProxyStatus `json:"proxies,omitempty"`
+}
+
+// Note a subtask starts running. Call the returned function with its outcome when it is done.
+// Only the first call counts.
+func (s *Satellite) begin(sb *dispatcher.Subtask) func(outcome string) {
+	s.mu.Lock()
+	s.running[sb.ID] = InFlight{
+		ID:      sb.ID,
+		Handler: sb.Handler,
+		Type:    sb.Type,
+		Started: time.Now(),
+	}
+	s.mu.Unlock()
+
+	ended := false
+	return func(outcome string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if ended {
+			return
+		}
+		ended = true
+		delete(s.running, sb.ID)
+		s.noteLocked(sb.Type, outcome)
+	}
+}
+
+// Called with s.mu held.
+func (s *Satellite) noteLocked(typ dispatcher.SubtaskType, outcome string) {
+	recent := append(s.outcomes[typ], outcome)
+	if len(recent) > RecentOutcomes {
+		recent = recent[len(recent)-RecentOutcomes:]
+	}
+	s.outcomes[typ] = recent
+}
+
+// What the satellite is doing, served by `StatusHandler`.
+func (s *Satellite) Status() Status {
+	now := time.Now()
+	st := Status{
+		Name:          s.office.name,
+		Labels:        s.office.labels,
+		Started:       s.started,
+		UptimeSeconds: int64(now.Sub(s.started) / time.Second),
+		ShuttingDown:  s.pulling.Err() != nil,
+		Workers:       client.RegisteredWorkerList(),
+		ConfigVersion: s.office.ConfigVersion(),
+		InFlight:      make([]InFlight, 0),
+		Outcomes:      make(map[dispatcher.SubtaskType]map[string]int),
+		Servers:       s.office.Servers(),
+		Proxies:       client.Proxies(),
+	}
+	for _, sv := range st.Servers {
+		if sv.Failures == 0 && !sv.LastOK.IsZero() {
+			st.Connected = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st.Routines = s.routines
+	st.MinRoutines = s.min
+	st.MaxRoutines = s.max
+	for _, v := range s.running {
+		v.AgeMs = int64(now.Sub(v.Started) / time.Millisecond)
+		st.InFlight = append(st.InFlight, v)
+	}
+	sort.Slice(st.InFlight, func(i, j int) bool {
+		return st.InFlight[i].Started.Before(st.InFlight[j].Started)
+	})
+	for typ, recent := range s.outcomes {
+		counts := make(map[string]int)
+		for _, v := range recent {
+			counts[v]++
+		}
+		st.Outcomes[typ] = counts
+	}
+	return st
+}
+
+// Serves
+//   - /healthz: 200 while the satellite runs, and 503 once it is shutting down.
+//   - /status: `Status` in JSON.
+func (s *Satellite) StatusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if s.pulling.Err() != nil {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	})
+	return mux
+}
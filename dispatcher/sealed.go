@@ -0,0 +1,163 @@
+package dispatcher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Credentials sealed by the user's browser or CLI to a worker key of the handler,
+// whose private half only approved satellites hold. The server stores and relays
+// them as they are, in place of the password, and never reads them.
+//
+// A sealed password looks like "sealed:<key ID>:<wrapped key>:<content>", where
+//   - key ID is `KeyID` of the worker public key,
+//   - wrapped key is a random AES-256 key encrypted with RSA-OAEP (SHA-256), in base64,
+//   - content is a 12 byte nonce followed by the AES-GCM ciphertext of
+//     `SealedCredentials` in JSON, in base64.
+//
+// All of these are available in WebCrypto.
+const SealedPrefix = "sealed:"
+
+const (
+	sealedKeyLength   = 32
+	sealedNonceLength = 12
+)
+
+// What is sealed. Handler and user ID are checked when unsealing, so that
+// sealed passwords could not be moved to another user.
+type SealedCredentials struct {
+	Handler  string `json:"handler"`
+	UserID   string `json:"userid"`
+	Password string `json:"password"`
+}
+
+var (
+	ErrInvalidSealed  = errors.New("invalid sealed credentials")
+	ErrSealedMismatch = errors.New("sealed credentials of another user")
+)
+
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, SealedPrefix)
+}
+
+func splitSealed(s string) ([]string, error) {
+	if !IsSealed(s) {
+		return nil, ErrInvalidSealed
+	}
+	parts := strings.Split(s[len(SealedPrefix):], ":")
+	if len(parts) != 3 || len(parts[0]) != KeyIDLength {
+		return nil, ErrInvalidSealed
+	}
+	return parts, nil
+}
+
+// ID of the worker key the credentials are sealed to.
+func SealedKeyID(s string) (string, error) {
+	parts, err := splitSealed(s)
+	if err != nil {
+		return "", err
+	}
+	return parts[0], nil
+}
+
+// Label of satellites holding the worker key, which subtasks carrying
+// credentials sealed to it select.
+func WorkerKeyLabel(keyID string) string {
+	return workerKeyPrefix + keyID
+}
+
+const workerKeyPrefix = "worker-key/"
+
+// Labels without worker key labels, and whether there were any. Satellites only claim
+// worker keys they hold, see `client.WorkerKeyLabels`, never those given by hand.
+func WithoutWorkerKeys(l Labels) (Labels, bool) {
+	res := make(Labels)
+	stripped := false
+	for k, v := range l {
+		if strings.HasPrefix(k, workerKeyPrefix) {
+			stripped = true
+			continue
+		}
+		res[k] = v
+	}
+	return res, stripped
+}
+
+func Seal(pub *rsa.PublicKey, c SealedCredentials) (string, error) {
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	key := make([]byte, sealedKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, sealedNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	content := gcm.Seal(nonce, nonce, plain, nil)
+	return SealedPrefix + strings.Join([]string{
+		KeyID(pub),
+		base64.StdEncoding.EncodeToString(wrapped),
+		base64.StdEncoding.EncodeToString(content),
+	}, ":"), nil
+}
+
+func Unseal(priv *rsa.PrivateKey, s string) (*SealedCredentials, error) {
+	parts, err := splitSealed(s)
+	if err != nil {
+		return nil, err
+	}
+	if parts[0] != KeyID(&priv.PublicKey) {
+		return nil, ErrInvalidSealed
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	content, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(content) < sealedNonceLength {
+		return nil, ErrInvalidSealed
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, wrapped, nil)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	plain, err := gcm.Open(nil, content[:sealedNonceLength], content[sealedNonceLength:], nil)
+	if err != nil {
+		return nil, ErrInvalidSealed
+	}
+	var c SealedCredentials
+	if err := json.Unmarshal(plain, &c); err != nil {
+		return nil, ErrInvalidSealed
+	}
+	return &c, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
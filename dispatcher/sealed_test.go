@@ -0,0 +1,59 @@
+package dispatcher_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+func TestSealAndUnseal(t *testing.T) {
+	priv, _ := dispatcher.ParsePrivateKey(mustGenerate(t))
+	other, _ := dispatcher.ParsePrivateKey(mustGenerate(t))
+
+	c := dispatcher.SealedCredentials{Handler: "pku", UserID: "marisa", Password: "霧雨魔理沙"}
+	sealed, err := dispatcher.Seal(&priv.PublicKey, c)
+	if err != nil {
+		t.Fatalf("Error sealing: %s", err.Error())
+	}
+	if !dispatcher.IsSealed(sealed) || strings.Contains(sealed, c.Password) {
+		t.Fatalf("Password is not sealed: %s", sealed)
+	}
+	if id, err := dispatcher.SealedKeyID(sealed); err != nil || id != dispatcher.KeyID(&priv.PublicKey) {
+		t.Fatalf("Wrong key ID of sealed credentials: %s, %v", id, err)
+	}
+
+	opened, err := dispatcher.Unseal(priv, sealed)
+	if err != nil || *opened != c {
+		t.Fatalf("Credentials corrupted after unsealing: %v, %v", opened, err)
+	}
+
+	tampered := sealed[:len(sealed)-4] + "AAA="
+	for _, s := range []string{tampered, "sealed:", "alice", sealed + ":x"} {
+		if _, err := dispatcher.Unseal(priv, s); err != dispatcher.ErrInvalidSealed {
+			t.Fatalf("Invalid sealed credentials %q are unsealed: %v", s, err)
+		}
+	}
+	if _, err := dispatcher.Unseal(other, sealed); err != dispatcher.ErrInvalidSealed {
+		t.Fatalf("Credentials are unsealed with another key: %v", err)
+	}
+}
+
+func mustGenerate(t *testing.T) []byte {
+	data, err := dispatcher.GenerateKey(1024)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err.Error())
+	}
+	return data
+}
+
+func TestWithoutWorkerKeys(t *testing.T) {
+	given := dispatcher.Labels{"network": "campus", dispatcher.WorkerKeyLabel("forged"): "true"}
+	labels, stripped := dispatcher.WithoutWorkerKeys(given)
+	if !stripped || len(labels) != 1 || labels["network"] != "campus" {
+		t.Fatalf("Worker key labels are not stripped: %s", labels)
+	}
+	if _, stripped := dispatcher.WithoutWorkerKeys(labels); stripped {
+		t.Fatalf("Nothing to strip, but reported stripped")
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Status of a queue, see `queueName` and `labelledQueue`.
+type QueueStatus struct {
+	Name    string `json:"name"`
+	Handler string `json:"handler"`
+
+	// Subtasks waiting in the queue, not leased, cancelled or timed out.
+	Depth int `json:"depth"`
+
+	// Age of the oldest subtask waiting, in seconds.
+	OldestAge float64 `json:"oldest_age"`
+
+	Paused bool `json:"paused"`
+}
+
+// A subtask whose result has not come yet, with credentials redacted.
+type PendingStatus struct {
+	ID        int64                  `json:"id"`
+	Handler   string                 `json:"handler"`
+	Type      dispatcher.SubtaskType `json:"type"`
+	Queue     string                 `json:"queue"`
+	Tags      []string               `json:"tags,omitempty"`
+	Affinity  string                 `json:"affinity,omitempty"`
+	Satellite string                 `json:"satellite,omitempty"` // Empty if it is still queued.
+	Cancelled bool                   `json:"cancelled"`
+	Age       float64                `json:"age"` // In seconds
+	Deadline  time.Time              `json:"deadline"`
+	Payload   json.RawMessage        `json:"payload,omitempty"`
+	Data      []string               `json:"data,omitempty"`
+}
+
+const redacted = "[redacted]"
+
+// Fields of payloads whose names contain any of these are redacted.
+var sensitiveFields = []string{"password", "session", "secret", "cookie"}
+
+func sensitive(field string) bool {
+	field = strings.ToLower(field)
+	for _, v := range sensitiveFields {
+		if strings.Contains(field, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			if sensitive(k) {
+				t[k] = redacted
+			} else {
+				t[k] = redact(vv)
+			}
+		}
+	case []interface{}:
+		for k, vv := range t {
+			t[k] = redact(vv)
+		}
+	}
+	return v
+}
+
+func redactPayload(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return json.RawMessage(`"` + redacted + `"`)
+	}
+	res, err := json.Marshal(redact(v))
+	if err != nil {
+		return json.RawMessage(`"` + redacted + `"`)
+	}
+	return res
+}
+
+// Handler of a queue name.
+func queueHandler(name string) string {
+	return strings.SplitN(name, "/", 2)[0]
+}
+
+func (d *Dispatcher) Queues() []QueueStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	names := make([]string, 0, len(d.queue))
+	for k, _ := range d.queue {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	status := make(map[string]*QueueStatus)
+	res := make([]QueueStatus, len(names))
+	for i, v := range names {
+		res[i] = QueueStatus{
+			Name:    v,
+			Handler: queueHandler(v),
+			Paused:  d.paused[queueHandler(v)],
+		}
+		status[v] = &res[i]
+	}
+	for _, p := range d.pending {
+		if p.satellite != "" || p.cancelled {
+			continue
+		}
+		qs, ok := status[subtaskQueue(p.subtask)]
+		if !ok {
+			continue
+		}
+		qs.Depth++
+		if age := now.Sub(p.pushed).Seconds(); age > qs.OldestAge {
+			qs.OldestAge = age
+		}
+	}
+	return res
+}
+
+// Pending subtasks of the handler, oldest first. Empty handler means all handlers.
+// Credentials in payloads are redacted, and so is all legacy data.
+func (d *Dispatcher) PendingSubtasks(handler string) []PendingStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := time.Now()
+	res := make([]PendingStatus, 0)
+	for _, p := range d.pending {
+		s := p.subtask
+		if handler != "" && s.Handler != handler {
+			continue
+		}
+		var data []string
+		if len(s.Data) > 0 {
+			data = make([]string, len(s.Data))
+			for i := range data {
+				data[i] = redacted
+			}
+		}
+		res = append(res, PendingStatus{
+			ID:        s.ID,
+			Handler:   s.Handler,
+			Type:      s.Type,
+			Queue:     subtaskQueue(s),
+			Tags:      s.Tags,
+			Affinity:  s.Affinity,
+			Satellite: p.satellite,
+			Cancelled: p.cancelled,
+			Age:       now.Sub(p.pushed).Seconds(),
+			Deadline:  s.Deadline,
+			Payload:   redactPayload(s.Payload),
+			Data:      data,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Age > res[j].Age
+	})
+	return res
+}
+
+// Stop handing out subtasks of the handler. Subtasks queued stay queued,
+// and new ones fail with `ErrPaused` at once.
+func (d *Dispatcher) Pause(handler string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.paused[handler] = true
+	log.Warnf("Dispatcher: handler %s paused", handler)
+}
+
+func (d *Dispatcher) Resume(handler string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.paused, handler)
+	log.Warnf("Dispatcher: handler %s resumed", handler)
+	d.matchLocked()
+}
+
+func (d *Dispatcher) Paused(handler string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.paused[handler]
+}
+
+// Fail all queued subtasks of the handler with `ErrDrained`.
+// Subtasks leased to satellites are left alone. Returns how many are drained.
+func (d *Dispatcher) Drain(handler string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count := 0
+	for _, p := range d.pending {
+		if p.subtask.Handler == handler && p.satellite == "" && d.abortLocked(p, ErrDrained) {
+			count++
+		}
+	}
+	log.Warnf("Dispatcher: handler %s drained, %d subtask(s) failed", handler, count)
+	return count
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+var (
+	// How long a subtask waits for the satellite it has affinity with,
+	// before any other satellite could take it. Zero disables affinity.
+	AffinityFallback = 2 * time.Second
+
+	// A satellite not polling for this long is taken as gone,
+	// and subtasks no longer wait for it.
+	SatelliteGone = 60 * time.Second
+
+	// A satellite not polling for this long is forgotten, along with its health and refusals,
+	// so that they do not grow with every satellite name ever seen. Quarantines are kept until released.
+	SatelliteForget = time.Hour
+
+	// How many subtasks could wait for one satellite. Beyond that
+	// the satellite is taken as saturated, and others take the subtasks.
+	StickyCapacity = 16
+)
+
+type satelliteState struct {
+	lastSeen time.Time
+	polling  int // Requests to /get_task in progress
+	labels   dispatcher.Labels
+	accepts  map[string]bool // Queues it accepts, see `queueName`.
+	config   string          // Version of the configuration it runs, see config.go.
+}
+
+func (s *satelliteState) alive() bool {
+	return s.polling > 0 || time.Since(s.lastSeen) < SatelliteGone
+}
+
+// Called when the satellite starts polling.
+func (d *Dispatcher) satelliteArrived(satellite string, labels dispatcher.Labels, accepts []string) {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	st, ok := d.satellites[satellite]
+	if !ok {
+		st = &satelliteState{}
+		d.satellites[satellite] = st
+	}
+	st.polling++
+	st.lastSeen = time.Now()
+	st.labels = labels
+	st.accepts = make(map[string]bool)
+	for _, v := range accepts {
+		st.accepts[v] = true
+	}
+}
+
+func (d *Dispatcher) satelliteLeft(satellite string) {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	st := d.satellites[satellite]
+	st.polling--
+	st.lastSeen = time.Now()
+}
+
+// Forget satellites gone for `SatelliteForget`. Runs at most once in that long.
+func (d *Dispatcher) forgetIdle() {
+	forget := d.settings.SatelliteForget
+	gone := make(map[string]bool)
+
+	d.mu.Lock()
+	d.smu.Lock()
+	if time.Since(d.forgotAt) < forget {
+		d.smu.Unlock()
+		d.mu.Unlock()
+		return
+	}
+	d.forgotAt = time.Now()
+	for name, st := range d.satellites {
+		if st.polling == 0 && time.Since(st.lastSeen) >= forget {
+			delete(d.satellites, name)
+			gone[name] = true
+		}
+	}
+	for key, satellite := range d.affinity {
+		if gone[satellite] {
+			delete(d.affinity, key)
+		}
+	}
+	for key, h := range d.health {
+		if _, ok := d.satellites[h.satellite]; !ok && !h.quarantined() {
+			delete(d.health, key)
+		}
+	}
+	d.smu.Unlock()
+	d.mu.Unlock()
+
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+
+	for key, v := range d.refused {
+		if gone[v.Satellite] {
+			delete(d.refused, key)
+		}
+	}
+	if len(gone) > 0 {
+		log.Infof("Dispatcher: forgot %d satellite(s) gone for %s", len(gone), forget)
+	}
+}
+
+// Later subtasks with the same affinity key prefer the satellite.
+func (d *Dispatcher) bindAffinity(key string, satellite string) {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	if d.affinity[key] != satellite {
+		log.Debugf("Dispatcher: affinity %s bound to satellite %s", key, satellite)
+	}
+	d.affinity[key] = satellite
+}
+
+// Send p to the satellite it has affinity with, if that satellite is alive and could take it.
+// p goes to the satellite at once if it is polling, or else waits in its sticky queue,
+// and is released back to its queue once the fallback passes.
+// Returns false if p is not routed, and anyone could take it.
+// Called with d.mu held.
+func (d *Dispatcher) routeLocked(p *pendingSubtask) bool {
+	s := p.subtask
+	key := s.Affinity
+	if key == "" || d.settings.AffinityFallback <= 0 {
+		return false
+	}
+
+	d.smu.Lock()
+	preferred, ok := d.affinity[key]
+	if !ok {
+		d.smu.Unlock()
+		return false
+	}
+	st, ok := d.satellites[preferred]
+	if !ok || !st.alive() {
+		// Gone
+		delete(d.affinity, key)
+		d.smu.Unlock()
+		return false
+	}
+	if !st.accepts[queueName(s.Handler, s.Type)] || !s.Selector.Selects(st.labels) {
+		d.smu.Unlock()
+		return false
+	}
+	d.smu.Unlock()
+	if d.quarantinedLocked(preferred, s.Handler) {
+		return false
+	}
+
+	if !d.paused[s.Handler] {
+		for e := d.pullers.Front(); e != nil; e = e.Next() {
+			pl := e.Value.(*puller)
+			if pl.satellite == preferred && d.takesLocked(pl, s) {
+				d.leaseLocked(p, pl)
+				return true
+			}
+		}
+	}
+	if l, ok := d.sticky[preferred]; ok && l.Len() >= StickyCapacity {
+		// Saturated
+		return false
+	}
+	d.offerStickyLocked(p, preferred)
+	p.fallback = d.wheel.AfterFunc(d.settings.AffinityFallback, func() {
+		d.release(p)
+	})
+	return true
+}
+
+// Put a subtask waiting in some sticky queue back to its queue, so that anyone could take it.
+func (d *Dispatcher) release(p *pendingSubtask) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p.done || !p.sticky || p.elem == nil {
+		return
+	}
+	d.unqueueLocked(p)
+	p.released = true
+	d.offerLocked(p)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Satellites scale their routines by the backlog hinted in every `TaskResponse`.
+var (
+	// How long each routine of a satellite should wait between polls when nothing is waiting.
+	// Satellites wait at least their own delay anyway.
+	IdlePollInterval = time.Duration(0)
+
+	// How long satellites that could take nothing are told to wait before polling again,
+	// e.g. when they accept no handler.
+	IdleRetryAfter = 10 * time.Second
+
+	// Same as `IdleRetryAfter`, but when every handler they accept is paused.
+	// Shorter, since handlers are paused for a while only, and work should resume at once.
+	PausedRetryAfter = time.Second
+)
+
+// Called with d.mu held.
+func (d *Dispatcher) backlogLocked(pl *puller) *dispatcher.Backlog {
+	b := &dispatcher.Backlog{}
+	if l, ok := d.sticky[pl.satellite]; ok {
+		b.QueueDepth += l.Len()
+	}
+	for _, q := range d.queue {
+		if q.list.Len() == 0 || d.paused[q.handler] || !pl.accepts[q.base] || !q.selector.Selects(pl.labels) ||
+			d.quarantinedLocked(pl.satellite, q.handler) {
+			continue
+		}
+		b.QueueDepth += q.list.Len()
+	}
+	if b.QueueDepth == 0 && d.settings.IdlePollInterval > 0 {
+		b.PollIntervalMs = int(d.settings.IdlePollInterval / time.Millisecond)
+	}
+	return b
+}
+
+// Subtasks waiting that the satellite could take, and how often it should poll.
+func (d *Dispatcher) backlog(satellite string, accepts []string, labels dispatcher.Labels) *dispatcher.Backlog {
+	pl := &puller{
+		satellite: satellite,
+		accepts:   make(map[string]bool),
+		labels:    labels,
+	}
+	for _, v := range accepts {
+		pl.accepts[v] = true
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.backlogLocked(pl)
+}
+
+// How long the satellite should wait before polling again, if it could take nothing
+// for a while: it accepts no queue, or every handler it accepts is paused, or it is
+// quarantined for them. Zero if it could take something.
+func (d *Dispatcher) retryAfter(satellite string, accepts []string) time.Duration {
+	if len(accepts) == 0 {
+		return d.settings.IdleRetryAfter
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var wait time.Duration
+	for _, name := range accepts {
+		handler := queueHandler(name)
+		var w time.Duration
+		if d.paused[handler] {
+			w = d.settings.PausedRetryAfter
+		} else if h, ok := d.health[healthKey(satellite, handler)]; ok && h.quarantined() {
+			w = time.Until(h.until)
+		} else {
+			return 0
+		}
+		if wait == 0 || w < wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// Tell the satellite to come back after d, in the body and in the Retry-After header.
+func writeRetryAfter(w http.ResponseWriter, d time.Duration, res dispatcher.TaskResponse) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int((d+time.Second-1)/time.Second)))
+	res.Backlog = &dispatcher.Backlog{
+		RetryAfterMs: int(d / time.Millisecond),
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+func TestBacklogHints(t *testing.T) {
+	settings := DefaultSettings()
+	settings.IdlePollInterval = time.Second
+	d := NewDispatcherWithSettings(1024, []string{"bench"}, settings)
+	accepts := []string{queueName("bench", opBench)}
+	if b := d.backlog("sat", accepts, nil); b.QueueDepth != 0 || b.PollIntervalMs != 1000 {
+		t.Fatalf("Wrong hints when idle: %+v", b)
+	}
+	for i := 0; i < 3; i++ {
+		d.PushSubtask(&dispatcher.Subtask{Handler: "bench", Type: opBench})
+	}
+	d.satelliteArrived("campus", dispatcher.Labels{"network": "campus"}, accepts)
+	d.PushSubtask(&dispatcher.Subtask{Handler: "bench", Type: opBench, Selector: dispatcher.Labels{"network": "campus"}})
+	if b := d.backlog("sat", accepts, nil); b.QueueDepth != 3 || b.PollIntervalMs != 0 {
+		t.Fatalf("Wrong hints with a backlog: %+v", b)
+	}
+	if b := d.backlog("sat", accepts, dispatcher.Labels{"network": "campus"}); b.QueueDepth != 4 {
+		t.Fatalf("Wrong hints for a satellite with labels: %+v", b)
+	}
+	if b := d.backlog("sat", nil, nil); b.QueueDepth != 0 {
+		t.Fatalf("Subtasks it does not accept are counted: %+v", b)
+	}
+
+	// Nothing to take for a while
+	if d.retryAfter("sat", accepts) != 0 {
+		t.Fatalf("Satellite is told to wait with a backlog")
+	}
+	if d.retryAfter("sat", nil) != IdleRetryAfter {
+		t.Fatalf("Satellite accepting nothing is not told to wait")
+	}
+	d.Quarantine("sat", "bench", time.Minute)
+	if w := d.retryAfter("sat", accepts); w <= IdleRetryAfter || w > time.Minute {
+		t.Fatalf("Quarantined satellite is told to wait %s", w)
+	}
+	if b := d.backlog("sat", accepts, nil); b.QueueDepth != 0 {
+		t.Fatalf("Quarantined satellite is hinted a backlog: %+v", b)
+	}
+	d.Pause("bench")
+	if w := d.retryAfter("sat", accepts); w != PausedRetryAfter {
+		t.Fatalf("Satellite of a paused handler is told to wait %s", w)
+	}
+	d.Drain("bench")
+}
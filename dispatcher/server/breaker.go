@@ -0,0 +1,234 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Circuit breaker of a handler, fed by outcomes of its subtasks.
+//
+// When the school system fails for most recent subtasks, the breaker opens, and
+// subtasks of the handler fail at once with `ErrCircuitOpen`, so that tasks back off.
+// After `BreakerCooldown` it is half-open, letting `BreakerProbes` subtasks through.
+// It closes if a probe succeeds, and opens again if a probe fails.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+var breakerStateNames = map[BreakerState]string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half-open",
+}
+
+func (s BreakerState) String() string {
+	return breakerStateNames[s]
+}
+
+func (s BreakerState) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", s.String())), nil
+}
+
+var (
+	// How many recent outcomes are considered.
+	BreakerWindow = 20
+
+	// The breaker never opens with fewer outcomes than this. Zero disables breakers.
+	BreakerMinRequests = 10
+
+	// The breaker opens when the ratio of failures among recent outcomes reaches this.
+	BreakerFailureRatio = 0.8
+
+	// How long the breaker stays open before letting probes through.
+	BreakerCooldown = 30 * time.Second
+
+	// How many probes could run at the same time when the breaker is half-open.
+	BreakerProbes = 1
+)
+
+type BreakerStatus struct {
+	Handler  string       `json:"handler"`
+	State    BreakerState `json:"state"`
+	Requests int          `json:"requests"` // Outcomes in the window
+	Failures int          `json:"failures"` // Failures in the window
+	OpenedAt time.Time    `json:"opened_at"`
+	Trips    int          `json:"trips"` // Times it opened
+}
+
+type breaker struct {
+	mu sync.Mutex
+
+	handler  string
+	settings Settings
+	metrics  *expvar.Map // Of the dispatcher, see metrics.go
+	state    BreakerState
+	outcomes []bool // Ring buffer of recent outcomes. True means failed.
+	next     int
+	failures int
+	openedAt time.Time
+	probing  int
+	trips    int
+}
+
+func newBreaker(handler string, settings Settings, metrics *expvar.Map) *breaker {
+	b := &breaker{
+		handler:  handler,
+		settings: settings,
+		metrics:  metrics,
+	}
+	b.publish()
+	return b
+}
+
+func (b *breaker) publish() {
+	state := new(expvar.String)
+	state.Set(b.state.String())
+	b.metrics.Set(fmt.Sprintf("breaker_state/%s", b.handler), state)
+}
+
+func (b *breaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	log.Warnf("Dispatcher: breaker of %s %s -> %s", b.handler, b.state, state)
+	b.state = state
+	switch state {
+	case BreakerOpen:
+		b.openedAt = time.Now()
+		b.trips++
+		b.metrics.Add(fmt.Sprintf("breaker_trips/%s", b.handler), 1)
+	case BreakerClosed:
+		b.outcomes = nil
+		b.next = 0
+		b.failures = 0
+	}
+	b.publish()
+}
+
+// Whether a subtask could go, and whether it goes as a probe.
+func (b *breaker) allow() (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.settings.BreakerCooldown {
+		b.setState(BreakerHalfOpen)
+	}
+	switch b.state {
+	case BreakerClosed:
+		return true, false
+	case BreakerHalfOpen:
+		if b.probing < b.settings.BreakerProbes {
+			b.probing++
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// Record the outcome of a subtask. Outcomes not counted only end probes.
+func (b *breaker) record(probe bool, counted bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing--
+		if !counted {
+			return
+		}
+		if failed {
+			b.setState(BreakerOpen)
+		} else {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+	if !counted || b.state != BreakerClosed || b.settings.BreakerMinRequests <= 0 {
+		// Subtasks pushed before the breaker opened are ignored.
+		return
+	}
+
+	if len(b.outcomes) < b.settings.BreakerWindow {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % b.settings.BreakerWindow
+	}
+	if failed {
+		b.failures++
+	}
+	if len(b.outcomes) >= b.settings.BreakerMinRequests &&
+		float64(b.failures) >= b.settings.BreakerFailureRatio*float64(len(b.outcomes)) {
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return BreakerStatus{
+		Handler:  b.handler,
+		State:    b.state,
+		Requests: len(b.outcomes),
+		Failures: b.failures,
+		OpenedAt: b.openedAt,
+		Trips:    b.trips,
+	}
+}
+
+// Whether the result tells something about the school system, and whether it failed.
+// Subtasks cancelled, or timed out before any satellite took them, tell nothing.
+// Nor do blocked results, which are about the satellite only, see `satelliteOutcomeOf`.
+func outcomeOf(leased bool, res *dispatcher.SubtaskResult) (bool, bool) {
+	if res.Error != nil {
+		return res.Error == ErrTimeout && leased, true
+	}
+	switch res.Status {
+	case dispatcher.StatusOK, dispatcher.StatusRejected, dispatcher.StatusSessionExpired:
+		return true, false
+	case dispatcher.StatusFailed:
+		return true, true
+	}
+	return false, false
+}
+
+func (d *Dispatcher) breaker(handler string) *breaker {
+	d.bmu.Lock()
+	defer d.bmu.Unlock()
+
+	b, ok := d.breakers[handler]
+	if !ok {
+		b = newBreaker(handler, d.settings, d.metrics)
+		d.breakers[handler] = b
+	}
+	return b
+}
+
+// Breakers of all handlers that have run subtasks.
+func (d *Dispatcher) Breakers() []BreakerStatus {
+	d.bmu.Lock()
+	res := make([]BreakerStatus, 0, len(d.breakers))
+	for _, b := range d.breakers {
+		res = append(res, b.status())
+	}
+	d.bmu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Handler < res[j].Handler
+	})
+	return res
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// A satellite the dispatcher refused to give some operation, because its worker is too old.
+type RefusedSatellite struct {
+	dispatcher.Refusal
+	Satellite string    `json:"satellite"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Subtasks are queued by handler and operation, so that a satellite
+// only pulls from the queues its workers are compatible with.
+func queueName(handler string, op dispatcher.SubtaskType) string {
+	return fmt.Sprintf("%s/%s", handler, op)
+}
+
+// Legacy satellites only tell which handlers they accept.
+func legacyCapabilities(accepts string) []dispatcher.Capability {
+	res := make([]dispatcher.Capability, 0)
+	for _, v := range strings.Split(accepts, ",") {
+		if v == "" {
+			continue
+		}
+		res = append(res, dispatcher.Capability{
+			Handler:       v,
+			WorkerVersion: 0,
+			Operations:    dispatcher.LegacyOperations,
+		})
+	}
+	return res
+}
+
+// Returns queues the satellite could pull from, and the operations refused to it.
+// Unsupported handlers and unregistered operations are filtered out silently.
+func (d *Dispatcher) matchCapabilities(caps []dispatcher.Capability) ([]string, []dispatcher.Refusal) {
+	accHash := make(map[string]bool)
+	for _, v := range d.avaliableHandlers {
+		accHash[v] = true
+	}
+
+	queues := make([]string, 0)
+	refused := make([]dispatcher.Refusal, 0)
+	for _, c := range caps {
+		if !accHash[c.Handler] {
+			continue
+		}
+		for _, name := range c.Operations {
+			op, err := dispatcher.GetOperation(c.Handler, name)
+			if err != nil {
+				continue
+			}
+			if c.WorkerVersion < op.MinWorkerVersion {
+				refused = append(refused, dispatcher.Refusal{
+					Handler:       c.Handler,
+					Operation:     name,
+					WorkerVersion: c.WorkerVersion,
+					MinVersion:    op.MinWorkerVersion,
+				})
+				continue
+			}
+			queues = append(queues, queueName(c.Handler, name))
+		}
+	}
+	return queues, refused
+}
+
+func refusalKey(satellite string, r dispatcher.Refusal) string {
+	return fmt.Sprintf("%s|%s|%s", satellite, r.Handler, r.Operation)
+}
+
+// Called on every poll. Refusals of the satellite that no longer hold are forgotten.
+func (d *Dispatcher) recordRefusals(satellite string, refused []dispatcher.Refusal) {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+
+	current := make(map[string]bool)
+	for _, r := range refused {
+		current[refusalKey(satellite, r)] = true
+	}
+	for k, v := range d.refused {
+		if v.Satellite == satellite && !current[k] {
+			delete(d.refused, k)
+		}
+	}
+
+	now := time.Now()
+	for _, r := range refused {
+		key := refusalKey(satellite, r)
+		rs, ok := d.refused[key]
+		if !ok || rs.WorkerVersion != r.WorkerVersion {
+			log.Warnf("Dispatcher: refused %s to satellite %s: worker version %d < %d",
+				queueName(r.Handler, r.Operation), satellite, r.WorkerVersion, r.MinVersion)
+		}
+		d.refused[key] = &RefusedSatellite{
+			Refusal:   r,
+			Satellite: satellite,
+			LastSeen:  now,
+		}
+	}
+}
+
+// Satellites that have been refused some operation, most recently seen first.
+func (d *Dispatcher) RefusedSatellites() []RefusedSatellite {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+
+	res := make([]RefusedSatellite, 0, len(d.refused))
+	for _, v := range d.refused {
+		res = append(res, *v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeen.After(res[j].LastSeen)
+	})
+	return res
+}
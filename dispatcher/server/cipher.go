@@ -3,53 +3,197 @@ package server
 import (
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
 	"errors"
 	"flag"
 	"io/ioutil"
-	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 
 	"github.com/applepi-icpc/icarus/dispatcher"
 )
 
 // アリス・マーガトロイド
 
-var (
-	flagPrivateKey = flag.String("priv", "private.pem", "Path of private key")
+/*
+ Each dispatcher holds several active private keys, identified by key ID (see `dispatcher.KeyID`).
+ Satellites tell which public key they encrypt with, so a new key pair can be rolled out:
+
+ 1. Generate a key pair with `icarus keys gen`, and load the private key, either by
+    adding it to `-priv` or at /dispatcher/keys/load.
+
+ 2. Give satellites the public half (`icarus keys pub`) at their own pace.
 
-	genkeyOnce sync.Once
-	privateKey *rsa.PrivateKey
+ 3. Once no satellite uses the old key (see the last use at /dispatcher/keys), retire it.
+
+ The first key loaded is the primary key, used by legacy satellites sending no key ID.
+*/
+
+var (
+	flagPrivateKey = flag.String("priv", "private.pem", "Paths of private keys, comma separated. The first one is the primary key")
 
-	ErrNoPrivateKeyFound = errors.New("no private key found")
+	ErrNoPrivateKeyFound = dispatcher.ErrNoKeyFound
+	ErrUnknownKey        = errors.New("unknown key")
+	ErrPrimaryKey        = errors.New("primary key could not be retired")
 )
 
+type privateKey struct {
+	key      *rsa.PrivateKey
+	path     string
+	loaded   time.Time
+	lastUsed time.Time
+	uses     int64
+}
+
+type privateKeyring struct {
+	once    sync.Once // Loads the keys given by `-priv`
+	mu      sync.Mutex
+	keys    map[string]*privateKey
+	primary string
+}
+
+func newPrivateKeyring() *privateKeyring {
+	return &privateKeyring{
+		keys: make(map[string]*privateKey),
+	}
+}
+
+type KeyStatus struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	Primary  bool      `json:"primary"`
+	Loaded   time.Time `json:"loaded"`
+	LastUsed time.Time `json:"last_used"`
+	Uses     int64     `json:"uses"`
+}
+
 func checkErr(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
 
+// Load the keys given by `-priv` into the dispatcher.
 // This function could be called any times you want, explicitly or implicitly.
-func InitPrivKey() {
-	genkeyOnce.Do(func() {
-		f, err := os.Open(*flagPrivateKey)
-		checkErr(err)
-		defer f.Close()
-
-		data, err := ioutil.ReadAll(f)
-		checkErr(err)
-
-		block, _ := pem.Decode(data)
-		if block == nil {
+func (d *Dispatcher) InitPrivKey() {
+	kr := d.keys
+	kr.once.Do(func() {
+		for _, path := range strings.Split(*flagPrivateKey, ",") {
+			path = strings.TrimSpace(path)
+			if path == "" {
+				continue
+			}
+			_, err := kr.load(path)
+			checkErr(err)
+		}
+		if kr.primary == "" {
 			panic(ErrNoPrivateKeyFound)
 		}
+	})
+}
+
+func (kr *privateKeyring) load(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key, err := dispatcher.ParsePrivateKey(data)
+	if err != nil {
+		return "", err
+	}
+	id := dispatcher.KeyID(&key.PublicKey)
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if k, ok := kr.keys[id]; ok {
+		k.path = path
+		return id, nil
+	}
+	kr.keys[id] = &privateKey{
+		key:    key,
+		path:   path,
+		loaded: time.Now(),
+	}
+	if kr.primary == "" {
+		kr.primary = id
+	}
+	log.Infof("Dispatcher: loaded private key %s from %s", id, path)
+	return id, nil
+}
+
+// The key of the ID, or the primary key if id is empty.
+func (kr *privateKeyring) get(id string) (*rsa.PrivateKey, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if id == "" {
+		id = kr.primary
+	}
+	k, ok := kr.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	k.lastUsed = time.Now()
+	k.uses++
+	return k.key, nil
+}
 
-		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-		checkErr(err)
+// Load one more private key, and returns its ID.
+func (d *Dispatcher) LoadPrivKey(path string) (string, error) {
+	d.InitPrivKey()
+	return d.keys.load(path)
+}
+
+// Stop accepting ciphers encrypted with the public half of the key.
+func (d *Dispatcher) RetirePrivKey(id string) error {
+	d.InitPrivKey()
+	kr := d.keys
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, ok := kr.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+	if id == kr.primary {
+		return ErrPrimaryKey
+	}
+	delete(kr.keys, id)
+	log.Warnf("Dispatcher: retired private key %s", id)
+	return nil
+}
+
+// Private keys active now, the primary one first.
+func (d *Dispatcher) Keys() []KeyStatus {
+	d.InitPrivKey()
+	kr := d.keys
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	res := make([]KeyStatus, 0, len(kr.keys))
+	for id, k := range kr.keys {
+		res = append(res, KeyStatus{
+			ID:       id,
+			Path:     k.path,
+			Primary:  id == kr.primary,
+			Loaded:   k.loaded,
+			LastUsed: k.lastUsed,
+			Uses:     k.uses,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Primary != res[j].Primary {
+			return res[i].Primary
+		}
+		return res[i].Loaded.Before(res[j].Loaded)
 	})
+	return res
 }
 
 const (
@@ -57,13 +201,18 @@ const (
 	KeyLength = 32
 )
 
-func GetNakedKey(cipher string) ([]byte, error) {
+// Decrypt the cipher with the private key of the ID, or the primary key if keyID is empty.
+func (d *Dispatcher) GetNakedKey(keyID string, cipher string) ([]byte, error) {
 	rawCipher, err := base64.StdEncoding.DecodeString(cipher)
 	if err != nil {
 		return nil, err
 	}
 
-	InitPrivKey()
+	d.InitPrivKey()
+	privateKey, err := d.keys.get(keyID)
+	if err != nil {
+		return nil, err
+	}
 	return rsa.DecryptPKCS1v15(rand.Reader, privateKey, rawCipher)
 }
 
@@ -75,8 +224,8 @@ func Decrypt(content string, orig []byte) (string, error) {
 	return dispatcher.Decrypt(content, orig)
 }
 
-func Encrypt(content string, key string) (string, error) {
-	r, err := GetNakedKey(key)
+func (d *Dispatcher) Encrypt(content string, keyID string, key string) (string, error) {
+	r, err := d.GetNakedKey(keyID, key)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Satellites fetch their configuration at startup from /get_config, and get it again
+// in the response to any poll once it changes, see `dispatcher.ConfigProfiles`.
+
+var (
+	flagSatelliteConfig = flag.String("satellite-config", "", "JSON file of satellite config profiles (see dispatcher.ConfigProfiles)")
+
+	profilesOnce    sync.Once
+	defaultProfiles dispatcher.ConfigProfiles
+)
+
+// The configuration of a satellite, and which version it runs.
+type SatelliteConfigStatus struct {
+	Satellite string            `json:"satellite"`
+	Labels    dispatcher.Labels `json:"labels"`
+	LastSeen  time.Time         `json:"last_seen"`
+	Running   string            `json:"running"` // Empty if it has got none
+	Expected  string            `json:"expected"`
+	UpToDate  bool              `json:"up_to_date"`
+}
+
+func ReadConfigProfiles(path string) (dispatcher.ConfigProfiles, error) {
+	var p dispatcher.ConfigProfiles
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return p, err
+	}
+	return p, p.Validate()
+}
+
+// Profiles given by `-satellite-config`.
+// This function could be called any times you want.
+func getDefaultProfiles() dispatcher.ConfigProfiles {
+	profilesOnce.Do(func() {
+		if *flagSatelliteConfig == "" {
+			return
+		}
+		var err error
+		defaultProfiles, err = ReadConfigProfiles(*flagSatelliteConfig)
+		if err != nil {
+			log.Fatalf("Invalid satellite config %q: %s", *flagSatelliteConfig, err.Error())
+		}
+	})
+	return defaultProfiles
+}
+
+func (d *Dispatcher) ConfigProfiles() dispatcher.ConfigProfiles {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	return d.profiles
+}
+
+// Replace the profiles. Satellites get their new configurations as they poll.
+func (d *Dispatcher) SetConfigProfiles(p dispatcher.ConfigProfiles) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	d.profiles = p
+	log.Infof("Dispatcher: satellite config profiles updated")
+	return nil
+}
+
+func (d *Dispatcher) ResolveConfig(satellite string, labels dispatcher.Labels) dispatcher.SatelliteProfile {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	return d.profiles.Resolve(satellite, labels)
+}
+
+// Note the version of the configuration the satellite runs.
+func (d *Dispatcher) noteConfig(satellite string, running string) {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	if st, ok := d.satellites[satellite]; ok {
+		st.config = running
+	}
+}
+
+// The profile of the satellite encrypted with key, if it should run another version than it does.
+func (d *Dispatcher) configUpdate(satellite string, labels dispatcher.Labels, running string, key []byte) string {
+	d.smu.Lock()
+	p := d.profiles.Resolve(satellite, labels)
+	d.smu.Unlock()
+
+	if p.Version == running {
+		return ""
+	}
+	content, err := encryptProfile(p, key)
+	if err != nil {
+		// Sent with a later poll.
+		log.Errorf("Dispatcher: error encrypting config of %s: %s", satellite, err.Error())
+		return ""
+	}
+	return content
+}
+
+// Profiles never go in cleartext, since proxies in them may carry credentials.
+func encryptProfile(p dispatcher.SatelliteProfile, key []byte) (string, error) {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return NakedEncrypt(string(raw), key)
+}
+
+// Configurations of satellites seen, by name.
+func (d *Dispatcher) SatelliteConfigs() []SatelliteConfigStatus {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	res := make([]SatelliteConfigStatus, 0, len(d.satellites))
+	for name, st := range d.satellites {
+		expected := d.profiles.Resolve(name, st.labels).Version
+		res = append(res, SatelliteConfigStatus{
+			Satellite: name,
+			Labels:    st.labels,
+			LastSeen:  st.lastSeen,
+			Running:   st.config,
+			Expected:  expected,
+			UpToDate:  st.config == expected,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Satellite < res[j].Satellite
+	})
+	return res
+}
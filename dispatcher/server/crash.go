@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Workers that panicked, reported by satellites as `dispatcher.CodeWorkerCrashed`,
+// are recorded with the subtask, so that poison inputs could be found: the same
+// input crashing workers on several satellites has the same `CrashStatus.Input`.
+
+// How many recent crashes are kept.
+var CrashHistory = 100
+
+type CrashStatus struct {
+	SubtaskID int64                  `json:"subtask_id"`
+	Satellite string                 `json:"satellite"`
+	Handler   string                 `json:"handler"`
+	Type      dispatcher.SubtaskType `json:"type"`
+	Time      time.Time              `json:"time"`
+	Message   string                 `json:"message"`
+	Stack     string                 `json:"stack"`
+
+	// Fingerprint of the input, the same for the same input. Credentials are redacted.
+	Input   string          `json:"input"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Data    []string        `json:"data,omitempty"`
+}
+
+// Count of crashes of a satellite for a handler.
+type CrashCount struct {
+	Satellite string    `json:"satellite"`
+	Handler   string    `json:"handler"`
+	Crashes   int       `json:"crashes"`
+	Last      time.Time `json:"last"`
+}
+
+// Fingerprints are keyed by a secret of this process, so that credentials
+// in inputs could not be guessed from them.
+var crashSalt = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+func inputOf(s *dispatcher.Subtask) string {
+	h := hmac.New(sha256.New, crashSalt)
+	h.Write(s.Payload)
+	for _, v := range s.Data {
+		fmt.Fprintf(h, "\x00%s", v)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Called with d.mu held.
+func (d *Dispatcher) recordCrashLocked(p *pendingSubtask, r *dispatcher.SubtaskResult) {
+	s := p.subtask
+	c := CrashStatus{
+		SubtaskID: s.ID,
+		Satellite: p.satellite,
+		Handler:   s.Handler,
+		Type:      s.Type,
+		Time:      time.Now(),
+		Message:   r.Message,
+		Stack:     r.Stack,
+		Input:     inputOf(s),
+		Payload:   redactPayload(s.Payload),
+	}
+	if len(s.Data) > 0 {
+		c.Data = make([]string, len(s.Data))
+		for i := range c.Data {
+			c.Data[i] = redacted
+		}
+	}
+
+	d.crashes = append(d.crashes, c)
+	if len(d.crashes) > CrashHistory {
+		d.crashes = d.crashes[len(d.crashes)-CrashHistory:]
+	}
+	key := healthKey(p.satellite, s.Handler)
+	n, ok := d.crashCounts[key]
+	if !ok {
+		n = &CrashCount{
+			Satellite: p.satellite,
+			Handler:   s.Handler,
+		}
+		d.crashCounts[key] = n
+	}
+	n.Crashes++
+	n.Last = c.Time
+
+	p.span.Logger().Errorf("Dispatcher: worker of %s crashed on satellite %s, input %s: %s", s.Handler, p.satellite, c.Input, r.Message)
+	d.metrics.Add(fmt.Sprintf("crashes/%s", s.Handler), 1)
+}
+
+// Recent crashes of the handler, or of all handlers if it is empty, latest first.
+func (d *Dispatcher) Crashes(handler string) []CrashStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	res := make([]CrashStatus, 0)
+	for i := len(d.crashes) - 1; i >= 0; i-- {
+		if handler == "" || d.crashes[i].Handler == handler {
+			res = append(res, d.crashes[i])
+		}
+	}
+	return res
+}
+
+// Crashes of each satellite for each handler since the dispatcher started, most first.
+func (d *Dispatcher) CrashCounts() []CrashCount {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	res := make([]CrashCount, 0, len(d.crashCounts))
+	for _, v := range d.crashCounts {
+		res = append(res, *v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Crashes != res[j].Crashes {
+			return res[i].Crashes > res[j].Crashes
+		}
+		return strings.Compare(res[i].Satellite, res[j].Satellite) < 0
+	})
+	return res
+}
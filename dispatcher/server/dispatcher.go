@@ -1,18 +1,23 @@
 package server
 
 import (
+	"container/list"
+	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
-	"reflect"
-	"strings"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/applepi-icpc/icarus/client"
 	"github.com/applepi-icpc/icarus/dispatcher"
+	"github.com/applepi-icpc/icarus/trace"
 )
 
 type M map[string]interface{}
@@ -24,46 +29,189 @@ func writeJSON(w http.ResponseWriter, code int, v interface{}) {
 	checkErr(err)
 }
 
-var PushTimeout = map[dispatcher.SubtaskType]time.Duration{
-	dispatcher.SubtaskLogin: 10 * time.Second,
-	dispatcher.SubtaskList:  30 * time.Second,
-	dispatcher.SubtaskElect: 5 * time.Second,
-}
 var PullTimeout = 30 * time.Second
 
+// Timeouts and thresholds of one dispatcher, see the package variables of the same names.
+type Settings struct {
+	PullTimeout      time.Duration
+	AffinityFallback time.Duration
+	IdlePollInterval time.Duration
+	IdleRetryAfter   time.Duration
+	PausedRetryAfter time.Duration
+	SatelliteForget  time.Duration
+
+	BreakerWindow       int
+	BreakerMinRequests  int
+	BreakerFailureRatio float64
+	BreakerCooldown     time.Duration
+	BreakerProbes       int
+
+	QuarantineWindow       int
+	QuarantineMinRequests  int
+	QuarantineBlockedHits  int
+	QuarantineFailureRatio float64
+	QuarantineBase         time.Duration
+	QuarantineMax          time.Duration
+}
+
+// Settings given by the package variables.
+func DefaultSettings() Settings {
+	return Settings{
+		PullTimeout:      PullTimeout,
+		AffinityFallback: AffinityFallback,
+		IdlePollInterval: IdlePollInterval,
+		IdleRetryAfter:   IdleRetryAfter,
+		PausedRetryAfter: PausedRetryAfter,
+		SatelliteForget:  SatelliteForget,
+
+		BreakerWindow:       BreakerWindow,
+		BreakerMinRequests:  BreakerMinRequests,
+		BreakerFailureRatio: BreakerFailureRatio,
+		BreakerCooldown:     BreakerCooldown,
+		BreakerProbes:       BreakerProbes,
+
+		QuarantineWindow:       QuarantineWindow,
+		QuarantineMinRequests:  QuarantineMinRequests,
+		QuarantineBlockedHits:  QuarantineBlockedHits,
+		QuarantineFailureRatio: QuarantineFailureRatio,
+		QuarantineBase:         QuarantineBase,
+		QuarantineMax:          QuarantineMax,
+	}
+}
+
 var (
 	ErrFailedToLogin = errors.New("failed to login") // returned by concrete client
 	ErrInvalidData   = errors.New("invalid data")    // returned by concrete client
 	ErrWrongType     = errors.New("wrong session type")
 	ErrTimeout       = errors.New("subtask timeout")
+	ErrCancelled     = errors.New("subtask cancelled")
+	ErrUnsatisfiable = errors.New("no live satellite satisfies the selector")
+	ErrPaused        = &backOffError{"handler paused"}
+	ErrDrained       = errors.New("subtask drained")
+	ErrCircuitOpen   = &backOffError{"circuit breaker open"}
+	ErrQueueFull     = &backOffError{"queue full"}
 )
 
+// Errors after which tasks should back off, see `client.BackOffError`.
+type backOffError struct {
+	msg string
+}
+
+func (e *backOffError) Error() string { return e.msg }
+func (e *backOffError) BackOff() bool { return true }
+
+var _ client.BackOffError = ErrPaused
+
 var randomizer = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 type Dispatcher struct {
 	mux *http.ServeMux
 
-	mu  sync.RWMutex
-	qmu sync.Mutex
+	// Locks are taken in this order, and never the other way around:
+	// mu, then smu (satellites, see `routeLocked`) or bmu (breakers, see `breaker`),
+	// then locks of a breaker or of the timer wheel.
+	// rmu and fmu are never held with another one.
+	mu  sync.RWMutex // Queues, pullers, pending subtasks, quarantines and crashes
+	rmu sync.Mutex   // Refused satellites, see capability.go
+	fmu sync.Mutex   // Faults, see fault.go
+	smu sync.Mutex   // Satellites, affinity and config profiles
+	bmu sync.Mutex   // The breaker of each handler
 
 	queueCapacity     int
 	avaliableHandlers []string
+	settings          Settings
+
+	keys        *privateKeyring // See cipher.go
+	metricsName string
+	metrics     *expvar.Map // See metrics.go
+
+	// Subtasks waiting for satellites, and satellites waiting for subtasks.
+	// Either side is matched with the other as soon as it comes, see match.go.
+	queue   map[string]*waitQueue // Handler/Operation?Selector -> Queue
+	sticky  map[string]*list.List // Satellite -> Subtasks waiting for it
+	pullers *list.List            // Polls waiting, oldest first
+	wheel   timerWheel
+
+	pending map[int64]*pendingSubtask        // ID -> Subtask
+	tags    map[string]map[int64]bool        // Tag -> IDs
+	revoked map[string]map[int64]*wheelTimer // Satellite -> IDs leased to it, then cancelled -> Expiry
+	cipher  map[int64][]byte                 // ID -> Cipher
+	refused map[string]*RefusedSatellite     // Satellite|Handler|Operation -> Refusal
+
+	satellites map[string]*satelliteState  // Satellite -> State
+	affinity   map[string]string           // Affinity key -> Satellite
+	paused     map[string]bool             // Handler -> Paused
+	breakers   map[string]*breaker         // Handler -> Breaker
+	health     map[string]*satelliteHealth // Satellite|Handler -> Health
+	faults     map[string]Faults           // Handler -> Faults injected, see fault.go
+
+	crashes     []CrashStatus          // Most recent last, see crash.go
+	forgotAt    time.Time              // Last time idle satellites were forgotten, guarded by smu. See `forgetIdle`.
+	crashCounts map[string]*CrashCount // Satellite|Handler -> Count
+
+	profiles dispatcher.ConfigProfiles // Guarded by smu, see config.go
+}
 
-	queue  map[string]chan *dispatcher.Subtask      // Handler -> Queue
-	result map[int64]chan *dispatcher.SubtaskResult // ID -> Result
-	cipher map[int64][]byte                         // ID -> Cipher
+// A subtask pushed whose result has not come yet.
+// All fields are guarded by d.mu.
+type pendingSubtask struct {
+	subtask   *dispatcher.Subtask
+	result    chan *dispatcher.SubtaskResult // Buffered. Only the first result is sent.
+	span      *trace.Span
+	breaker   *breaker
+	timeout   *wheelTimer
+	cancelled bool
+	err       error  // Why it is cancelled, e.g. `ErrCancelled`, `ErrDrained`.
+	satellite string // Who leased it. Empty if it is still in the queue.
+	pushed    time.Time
+	probe     bool // Let through by a half-open breaker.
+	released  bool // No longer waiting for the satellite it has affinity with.
+	done      bool
+
+	// Where it waits: an element of d.queue[queued], or of d.sticky[queued] if sticky.
+	elem     *list.Element
+	queued   string
+	sticky   bool
+	fallback *wheelTimer // Releases it from the sticky queue, see `routeLocked`.
 }
 
 func NewDispatcher(capacity int, avaliableHandlers []string) *Dispatcher {
+	return NewDispatcherWithSettings(capacity, avaliableHandlers, DefaultSettings())
+}
+
+func NewDispatcherWithSettings(capacity int, avaliableHandlers []string, settings Settings) *Dispatcher {
 	t := &Dispatcher{
 		mux: http.NewServeMux(),
 
 		queueCapacity:     capacity,
 		avaliableHandlers: avaliableHandlers,
+		settings:          settings,
+		keys:              newPrivateKeyring(),
+
+		queue:   make(map[string]*waitQueue),
+		sticky:  make(map[string]*list.List),
+		pullers: list.New(),
+
+		pending: make(map[int64]*pendingSubtask),
+		tags:    make(map[string]map[int64]bool),
+		revoked: make(map[string]map[int64]*wheelTimer),
+		cipher:  make(map[int64][]byte),
+		refused: make(map[string]*RefusedSatellite),
 
-		queue:  make(map[string]chan *dispatcher.Subtask),
-		result: make(map[int64]chan *dispatcher.SubtaskResult),
-		cipher: make(map[int64][]byte),
+		satellites: make(map[string]*satelliteState),
+		affinity:   make(map[string]string),
+		paused:     make(map[string]bool),
+		breakers:   make(map[string]*breaker),
+		health:     make(map[string]*satelliteHealth),
+		faults:     make(map[string]Faults),
+
+		crashCounts: make(map[string]*CrashCount),
+
+		profiles: getDefaultProfiles(),
+	}
+	t.metricsName, t.metrics = publishMetrics()
+	for h, f := range getDefaultFaults() {
+		t.faults[h] = f
 	}
 
 	t.mux.HandleFunc("/get_task", func(w http.ResponseWriter, r *http.Request) {
@@ -75,54 +223,146 @@ func NewDispatcher(capacity int, avaliableHandlers []string) *Dispatcher {
 			return
 		}
 
-		// filter out unsupported handles
-		rawAccepts := strings.Split(request.Accepts, ",")
-		accHash := make(map[string]bool)
-		for _, v := range t.avaliableHandlers {
-			accHash[v] = true
+		satellite := request.Satellite
+		if satellite == "" {
+			// Legacy satellites have no names.
+			satellite, _, _ = net.SplitHostPort(r.RemoteAddr)
 		}
-		accepts := make([]string, 0)
-		for _, v := range rawAccepts {
-			_, ok := accHash[v]
-			if ok {
-				accepts = append(accepts, v)
-			}
+
+		// Before leasing anything, so that no subtask is lost to a key retired.
+		key, err := t.GetNakedKey(request.KeyID, request.Cipher)
+		if err != nil {
+			log.Warnf("Dispatcher: error decrypting cipher of %s (key %q): %s", satellite, request.KeyID, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		caps := request.Capabilities
+		if caps == nil {
+			caps = legacyCapabilities(request.Accepts)
 		}
 
-		subtask, err := t.pullSubtask(accepts)
+		// filter out unsupported handles and operations, and workers too old
+		accepts, refused := t.matchCapabilities(caps)
+		t.forgetIdle()
+		t.recordRefusals(satellite, refused)
+
+		t.satelliteArrived(satellite, request.Labels, accepts)
+		defer t.satelliteLeft(satellite)
+		t.noteConfig(satellite, request.ConfigVersion)
+
+		// No use waiting for what it could not take.
+		if retry := t.retryAfter(satellite, accepts); retry > 0 {
+			writeRetryAfter(w, retry, dispatcher.TaskResponse{
+				OK:        false,
+				Refused:   refused,
+				Cancelled: t.takeRevoked(satellite),
+				Config:    t.configUpdate(satellite, request.Labels, request.ConfigVersion, key),
+			})
+			return
+		}
+
+		subtask, err := t.pullSubtask(r.Context(), satellite, accepts, request.Labels)
 		if err != nil {
 			if err != ErrTimeout {
 				log.Errorf("Dispatcher: error getting subtask: %s", err.Error())
 				http.Error(w, "", http.StatusInternalServerError)
 			} else {
 				writeJSON(w, http.StatusOK, dispatcher.TaskResponse{
-					OK: false,
+					OK:        false,
+					Refused:   refused,
+					Cancelled: t.takeRevoked(satellite),
+					Backlog:   t.backlog(satellite, accepts, request.Labels),
+					Config:    t.configUpdate(satellite, request.Labels, request.ConfigVersion, key),
 				})
 			}
 			return
 		}
 
-		rawContent, err := json.Marshal(subtask)
+		// The deadline as time left, since the satellite's clock may be off.
+		leased := *subtask
+		leased.SetTTL()
+		rawContent, err := json.Marshal(&leased)
 		if err != nil {
-			log.Errorf("Dispatcher: error marshalling subtask: %s", err.Error())
+			log.WithFields(traceFields(subtask)).Errorf("Dispatcher: error marshalling subtask: %s", err.Error())
 			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
 
-		content, err := Encrypt(string(rawContent), request.Cipher)
+		content, err := NakedEncrypt(string(rawContent), key)
 		if err != nil {
-			log.Errorf("Dispatcher: error encrypting: %s", err.Error())
+			log.WithFields(traceFields(subtask)).Errorf("Dispatcher: error encrypting: %s", err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// record cipher
 		t.mu.Lock()
-		t.cipher[subtask.ID], _ = GetNakedKey(request.Cipher)
+		if _, ok := t.pending[subtask.ID]; ok {
+			t.cipher[subtask.ID] = key
+		}
 		t.mu.Unlock()
 
+		if !t.injectSubtask(w, subtask.Handler, subtask.ID, &content) {
+			return
+		}
+
 		writeJSON(w, http.StatusOK, dispatcher.TaskResponse{
-			OK:      true,
+			OK:        true,
+			Content:   content,
+			Refused:   refused,
+			Cancelled: t.takeRevoked(satellite),
+			Backlog:   t.backlog(satellite, accepts, request.Labels),
+			Config:    t.configUpdate(satellite, request.Labels, request.ConfigVersion, key),
+		})
+	})
+
+	t.mux.HandleFunc("/handshake", func(w http.ResponseWriter, r *http.Request) {
+		var request dispatcher.HandshakeRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			log.Errorf("Dispatcher: error getting request: %s", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key, err := t.GetNakedKey(request.KeyID, request.Cipher)
+		if err != nil {
+			log.Warnf("Dispatcher: error decrypting cipher of %s (key %q): %s", request.Satellite, request.KeyID, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, err := NakedEncrypt(request.Challenge, key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, dispatcher.HandshakeResponse{
+			Content:         content,
+			ProtocolVersion: dispatcher.ProtocolVersion,
+		})
+	})
+
+	t.mux.HandleFunc("/get_config", func(w http.ResponseWriter, r *http.Request) {
+		var request dispatcher.ConfigRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			log.Errorf("Dispatcher: error getting request: %s", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key, err := t.GetNakedKey(request.KeyID, request.Cipher)
+		if err != nil {
+			log.Warnf("Dispatcher: error decrypting cipher of %s (key %q): %s", request.Satellite, request.KeyID, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, err := encryptProfile(t.ResolveConfig(request.Satellite, request.Labels), key)
+		if err != nil {
+			log.Errorf("Dispatcher: error encrypting config of %s: %s", request.Satellite, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, dispatcher.ConfigResponse{
 			Content: content,
 		})
 	})
@@ -136,13 +376,30 @@ func NewDispatcher(capacity int, avaliableHandlers []string) *Dispatcher {
 			return
 		}
 
+		if t.forgetRevoked(resp.TaskID) {
+			// HTTP 409 (Conflict): The subtask has been cancelled.
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+
+		t.mu.RLock()
 		key, ok := t.cipher[resp.TaskID]
-		if !ok {
+		p, pok := t.pending[resp.TaskID]
+		var leasee string
+		if pok {
+			leasee = p.satellite
+		}
+		t.mu.RUnlock()
+		if !ok || !pok {
 			// HTTP 410 (Gone): Timeout, or no such task ID exists.
 			http.Error(w, "", http.StatusGone)
 			return
 		}
 
+		if !t.injectResult(w, p.subtask.Handler, resp.TaskID, &resp.Content) {
+			return
+		}
+
 		decrypted, err := Decrypt(resp.Content, key)
 		if err != nil {
 			log.Errorf("Dispatcher: error decrypting response: %s", err.Error())
@@ -158,14 +415,17 @@ func NewDispatcher(capacity int, avaliableHandlers []string) *Dispatcher {
 			return
 		}
 
-		t.mu.RLock()
-		ch, ok := t.result[resp.TaskID]
+		t.mu.Lock()
+		ok = t.finishLocked(p, &tres)
+		t.mu.Unlock()
 		if !ok {
+			// Someone has sent the result already, or it has timed out meanwhile.
 			http.Error(w, "", http.StatusGone)
 			return
 		}
-		ch <- &tres
-		t.mu.RUnlock()
+		if tres.Status == dispatcher.StatusOK && p.subtask.Affinity != "" {
+			t.bindAffinity(p.subtask.Affinity, leasee)
+		}
 	})
 
 	return t
@@ -175,18 +435,11 @@ func (d *Dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d.mux.ServeHTTP(w, r)
 }
 
-func (d *Dispatcher) ensureQueue(c string) (queue chan *dispatcher.Subtask) {
-	queue, ok := d.queue[c]
-	if !ok {
-		func() {
-			d.qmu.Lock()
-			defer d.qmu.Unlock()
-
-			queue = make(chan *dispatcher.Subtask, d.queueCapacity)
-			d.queue[c] = queue
-		}()
+func traceFields(s *dispatcher.Subtask) log.Fields {
+	return log.Fields{
+		"trace_id": s.Trace.TraceID,
+		"span_id":  s.Trace.SpanID,
 	}
-	return
 }
 
 func (d *Dispatcher) PushSubtask(s *dispatcher.Subtask) <-chan *dispatcher.SubtaskResult {
@@ -195,74 +448,277 @@ func (d *Dispatcher) PushSubtask(s *dispatcher.Subtask) <-chan *dispatcher.Subta
 
 	s.ID = randomizer.Int63()
 
-	q := d.ensureQueue(s.Handler)
-	timeout := PushTimeout[s.Type]
-	res := make(chan *dispatcher.SubtaskResult)
+	// Satellites continue the trace from the dispatcher's span.
+	span := trace.StartFrom(s.Trace, "dispatcher.subtask")
+	span.SetTag("handler", s.Handler)
+	span.SetTag("type", string(s.Type))
+	span.SetTag("subtask_id", fmt.Sprintf("%d", s.ID))
+	s.Trace = span.Context()
+
+	res := make(chan *dispatcher.SubtaskResult, 1)
+
+	// Timeout comes from the operation registered by the handle.
+	op, err := dispatcher.GetOperation(s.Handler, s.Type)
+	if err != nil {
+		span.SetError(err)
+		span.Logger().Errorf("Dispatcher: handler %s has no operation %s", s.Handler, s.Type)
+		span.Finish()
+		res <- &dispatcher.SubtaskResult{
+			Error: err,
+		}
+		return res
+	}
 
-	go func() {
-		tc := time.After(timeout)
+	// Tasks back off while the handler is paused.
+	if d.paused[s.Handler] {
+		span.SetError(ErrPaused)
+		span.Finish()
+		res <- &dispatcher.SubtaskResult{
+			Error: ErrPaused,
+		}
+		return res
+	}
 
-		select {
-		case <-tc:
-			res <- &dispatcher.SubtaskResult{
-				Error: ErrTimeout,
-			}
-			return
-		case q <- s:
-			// do nothing
+	// Fail fast rather than wait for the timeout.
+	s.Selector = dispatcher.MergeLabels(op.Selector, s.Selector)
+	if len(s.Selector) > 0 && !d.satisfiable(queueName(s.Handler, s.Type), s.Selector) {
+		span.SetError(ErrUnsatisfiable)
+		span.Logger().Warnf("Dispatcher: no live satellite could run %s with labels %s",
+			queueName(s.Handler, s.Type), s.Selector)
+		span.Finish()
+		res <- &dispatcher.SubtaskResult{
+			Error: ErrUnsatisfiable,
+		}
+		return res
+	}
+	if q, ok := d.queue[subtaskQueue(s)]; ok && q.list.Len() >= d.queueCapacity {
+		span.SetError(ErrQueueFull)
+		span.Logger().Warnf("Dispatcher: queue %s full", q.name)
+		span.Finish()
+		res <- &dispatcher.SubtaskResult{
+			Error: ErrQueueFull,
 		}
+		return res
+	}
 
-		d.mu.Lock()
-		ch := make(chan *dispatcher.SubtaskResult)
-		d.result[s.ID] = ch
-		d.mu.Unlock()
-
-		select {
-		case <-tc:
-			res <- &dispatcher.SubtaskResult{
-				Error: ErrTimeout,
-			}
-		case t := <-ch:
-			res <- t
+	// Tasks back off while the school system is failing.
+	b := d.breaker(s.Handler)
+	allowed, probe := b.allow()
+	if !allowed {
+		span.SetError(ErrCircuitOpen)
+		span.Finish()
+		res <- &dispatcher.SubtaskResult{
+			Error: ErrCircuitOpen,
+		}
+		return res
+	}
+
+	p := &pendingSubtask{
+		subtask: s,
+		result:  res,
+		span:    span,
+		breaker: b,
+		pushed:  time.Now(),
+		probe:   probe,
+	}
+	d.pending[s.ID] = p
+	for _, tag := range s.Tags {
+		ids, ok := d.tags[tag]
+		if !ok {
+			ids = make(map[int64]bool)
+			d.tags[tag] = ids
 		}
+		ids[s.ID] = true
+	}
 
+	// Satellites give up on the subtask once the dispatcher does.
+	s.Deadline = time.Now().Add(op.Timeout)
+	p.timeout = d.wheel.AfterFunc(op.Timeout, func() {
 		d.mu.Lock()
-		delete(d.result, s.ID)
-		close(ch)
-		delete(d.cipher, s.ID)
-		d.mu.Unlock()
-	}()
+		defer d.mu.Unlock()
 
+		if p.done {
+			return
+		}
+		if p.satellite == "" {
+			span.Logger().Warnf("Dispatcher: subtask %d timed out before being leased", s.ID)
+		} else {
+			span.Logger().Warnf("Dispatcher: subtask %d timed out", s.ID)
+		}
+		d.finishLocked(p, &dispatcher.SubtaskResult{
+			Error: ErrTimeout,
+		})
+	})
+
+	if !d.routeLocked(p) {
+		d.offerLocked(p)
+	}
 	return res
 }
 
+// Called when a subtask is finished, in whatever way. Only the first call counts,
+// returning true; later results, e.g. those after the timeout, are dropped.
+// Called with d.mu held.
+func (d *Dispatcher) finishLocked(p *pendingSubtask, r *dispatcher.SubtaskResult) bool {
+	if p.done {
+		return false
+	}
+	p.done = true
+	p.timeout.Stop()
+	d.unqueueLocked(p)
+
+	id := p.subtask.ID
+	for _, tag := range p.subtask.Tags {
+		delete(d.tags[tag], id)
+		if len(d.tags[tag]) == 0 {
+			delete(d.tags, tag)
+		}
+	}
+	delete(d.pending, id)
+	delete(d.cipher, id)
+
+	// Feed the breaker before the result goes.
+	counted, failed := outcomeOf(p.satellite != "", r)
+	p.breaker.record(p.probe, counted, failed)
+	if p.satellite != "" {
+		d.recordHealthLocked(p.satellite, p.subtask.Handler, r)
+		if r.Error == nil && r.Code == dispatcher.CodeWorkerCrashed {
+			d.recordCrashLocked(p, r)
+		}
+	}
+
+	if r.Error != nil {
+		p.span.SetError(r.Error)
+	}
+	p.span.Finish()
+	p.result <- r
+	return true
+}
+
 func (d *Dispatcher) RunSubtask(s *dispatcher.Subtask) *dispatcher.SubtaskResult {
 	ch := d.PushSubtask(s)
 	return <-ch
 }
 
-func (d *Dispatcher) pullSubtask(accepts []string) (*dispatcher.Subtask, error) {
-	tc := time.After(PullTimeout)
-	cases := make([]reflect.SelectCase, len(accepts)+1)
-	var timeoutIdx = len(accepts)
-	for i, v := range accepts {
-		q := d.ensureQueue(v)
-		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q)}
+// Same as RunSubtask, but the subtask is cancelled once ctx is done.
+func (d *Dispatcher) RunSubtaskContext(ctx context.Context, s *dispatcher.Subtask) *dispatcher.SubtaskResult {
+	ch := d.PushSubtask(s)
+	select {
+	case res := <-ch:
+		return res
+	case <-ctx.Done():
+		d.Cancel(s.ID)
+		return <-ch
+	}
+}
+
+// Cancel a subtask. Its result would be `ErrCancelled`.
+//
+// A queued subtask is purged at once.
+// If it has been leased, the satellite is told on its next poll or result submission.
+// Returns false if there is no such subtask, or it has been finished or cancelled.
+func (d *Dispatcher) Cancel(id int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.pending[id]
+	if !ok {
+		return false
 	}
-	cases[timeoutIdx] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(tc)}
+	return d.abortLocked(p, ErrCancelled)
+}
 
-	for {
-		chosen, value, _ := reflect.Select(cases)
-		if chosen == timeoutIdx {
-			return nil, ErrTimeout
+// Cancel all subtasks with the tag. Returns how many are cancelled.
+func (d *Dispatcher) CancelTag(tag string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count := 0
+	for id, _ := range d.tags[tag] {
+		if d.abortLocked(d.pending[id], ErrCancelled) {
+			count++
 		}
+	}
+	return count
+}
+
+// Make the subtask fail with err. Satellites treat it as cancelled.
+func (d *Dispatcher) abortLocked(p *pendingSubtask, err error) bool {
+	if p.cancelled || p.done {
+		return false
+	}
+	p.cancelled = true
+	p.err = err
+	if p.satellite != "" {
+		d.revokeLocked(p.satellite, p.subtask)
+	}
+	log.WithFields(traceFields(p.subtask)).Infof("Dispatcher: subtask %d aborted: %s", p.subtask.ID, err.Error())
+	return d.finishLocked(p, &dispatcher.SubtaskResult{
+		Error: err,
+	})
+}
+
+// Tell the satellite on its next poll or result submission that the subtask is cancelled.
+// It is forgotten once the deadline passes, as the satellite gives up on the subtask by then,
+// or else it would stay here for good if the satellite is gone.
+// Called with d.mu held.
+func (d *Dispatcher) revokeLocked(satellite string, s *dispatcher.Subtask) {
+	ids, ok := d.revoked[satellite]
+	if !ok {
+		ids = make(map[int64]*wheelTimer)
+		d.revoked[satellite] = ids
+	}
+	id := s.ID
+	ids[id] = d.wheel.AfterFunc(time.Until(s.Deadline), func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		d.unrevokeLocked(satellite, id)
+	})
+}
+
+// Called with d.mu held.
+func (d *Dispatcher) unrevokeLocked(satellite string, id int64) bool {
+	ids := d.revoked[satellite]
+	expiry, ok := ids[id]
+	if !ok {
+		return false
+	}
+	expiry.Stop()
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(d.revoked, satellite)
+	}
+	return true
+}
+
+// IDs of subtasks leased to the satellite and cancelled since its last poll.
+func (d *Dispatcher) takeRevoked(satellite string) []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := make([]int64, 0, len(d.revoked[satellite]))
+	for id := range d.revoked[satellite] {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		d.unrevokeLocked(satellite, id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+// Returns true if the subtask was leased and then cancelled, and the satellite has not been told yet.
+func (d *Dispatcher) forgetRevoked(id int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		subtask := value.Interface().(*dispatcher.Subtask)
-		d.mu.RLock()
-		_, ok := d.result[subtask.ID]
-		d.mu.RUnlock()
-		if ok {
-			return subtask, nil
+	for satellite := range d.revoked {
+		if d.unrevokeLocked(satellite, id) {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Faults injected into the traffic of a handler, to rehearse how tasks behave
+// when satellites are slow, messages are lost or ciphertexts are corrupted.
+// Rates are probabilities from 0 to 1.
+type Faults struct {
+	// Hold subtasks and results for DelayMs before handling them.
+	DelayRate float64 `json:"delay_rate"`
+	DelayMs   int     `json:"delay_ms"`
+
+	// Lease subtasks but tell satellites there is none, so that they time out.
+	DropSubtask float64 `json:"drop_subtask"`
+
+	// Accept results but throw them away, so that subtasks time out.
+	DropResult float64 `json:"drop_result"`
+
+	// Fail requests with HTTP 500. Subtasks leased are lost and time out.
+	ServerError float64 `json:"server_error"`
+
+	// Flip a bit of encrypted subtasks and results.
+	Corrupt float64 `json:"corrupt"`
+}
+
+// Faults for handlers without faults of their own.
+const AllHandlers = "*"
+
+var (
+	flagFaults = flag.String("faults", "", "Faults to inject, e.g. pku:drop_result=0.1,delay_rate=0.5,delay_ms=300;*:corrupt=0.01")
+
+	ErrInvalidFaults = errors.New("invalid faults")
+
+	faultsOnce    sync.Once
+	defaultFaults map[string]Faults
+)
+
+// Parse faults given in the form of `-faults`.
+func ParseFaults(s string) (map[string]Faults, error) {
+	res := make(map[string]Faults)
+	for _, v := range strings.Split(s, ";") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, ErrInvalidFaults
+		}
+		var f Faults
+		for _, kv := range strings.Split(parts[1], ",") {
+			pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(pair) != 2 {
+				return nil, ErrInvalidFaults
+			}
+			if pair[0] == "delay_ms" {
+				ms, err := strconv.Atoi(pair[1])
+				if err != nil || ms < 0 {
+					return nil, ErrInvalidFaults
+				}
+				f.DelayMs = ms
+				continue
+			}
+			rate, err := strconv.ParseFloat(pair[1], 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, ErrInvalidFaults
+			}
+			switch pair[0] {
+			case "delay_rate":
+				f.DelayRate = rate
+			case "drop_subtask":
+				f.DropSubtask = rate
+			case "drop_result":
+				f.DropResult = rate
+			case "server_error":
+				f.ServerError = rate
+			case "corrupt":
+				f.Corrupt = rate
+			default:
+				return nil, ErrInvalidFaults
+			}
+		}
+		res[parts[0]] = f
+	}
+	return res, nil
+}
+
+// Faults given by `-faults`.
+// This function could be called any times you want.
+func getDefaultFaults() map[string]Faults {
+	faultsOnce.Do(func() {
+		var err error
+		defaultFaults, err = ParseFaults(*flagFaults)
+		if err != nil {
+			log.Fatalf("Invalid faults %q: %s", *flagFaults, err.Error())
+		}
+		for h, f := range defaultFaults {
+			log.Warnf("Dispatcher: injecting faults into %s: %+v", h, f)
+		}
+	})
+	return defaultFaults
+}
+
+func (f Faults) roll(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// Sleep if a delay is due.
+func (f Faults) delay() {
+	if f.roll(f.DelayRate) {
+		time.Sleep(time.Duration(f.DelayMs) * time.Millisecond)
+	}
+}
+
+// Flip a bit of a base64 ciphertext, so that it fails validation.
+func corrupt(content string) string {
+	raw, err := base64.StdEncoding.DecodeString(content)
+	if err != nil || len(raw) == 0 {
+		return content
+	}
+	raw[rand.Intn(len(raw))] ^= 1 << uint(rand.Intn(8))
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func (d *Dispatcher) faultsOf(handler string) Faults {
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+
+	if f, ok := d.faults[handler]; ok {
+		return f
+	}
+	return d.faults[AllHandlers]
+}
+
+// Count an injected fault, published at /debug/vars, e.g. "faults/pku/drop_result".
+func (d *Dispatcher) injected(handler string, fault string, id int64) {
+	log.Infof("Dispatcher: injected %s into subtask %d of %s", fault, id, handler)
+	d.metrics.Add(fmt.Sprintf("faults/%s/%s", handler, fault), 1)
+}
+
+// Inject faults into the response of /get_task. Returns false if the response has been written.
+func (d *Dispatcher) injectSubtask(w http.ResponseWriter, handler string, id int64, content *string) bool {
+	f := d.faultsOf(handler)
+	f.delay()
+	if f.roll(f.ServerError) {
+		d.injected(handler, "server_error", id)
+		http.Error(w, "injected fault", http.StatusInternalServerError)
+		return false
+	}
+	if f.roll(f.DropSubtask) {
+		d.injected(handler, "drop_subtask", id)
+		writeJSON(w, http.StatusOK, dispatcher.TaskResponse{
+			OK: false,
+		})
+		return false
+	}
+	if f.roll(f.Corrupt) {
+		d.injected(handler, "corrupt", id)
+		*content = corrupt(*content)
+	}
+	return true
+}
+
+// Inject faults into a request of /put_result. Returns false if the response has been written.
+func (d *Dispatcher) injectResult(w http.ResponseWriter, handler string, id int64, content *string) bool {
+	f := d.faultsOf(handler)
+	f.delay()
+	if f.roll(f.ServerError) {
+		d.injected(handler, "server_error", id)
+		http.Error(w, "injected fault", http.StatusInternalServerError)
+		return false
+	}
+	if f.roll(f.DropResult) {
+		d.injected(handler, "drop_result", id)
+		w.WriteHeader(http.StatusOK)
+		return false
+	}
+	if f.roll(f.Corrupt) {
+		d.injected(handler, "corrupt", id)
+		*content = corrupt(*content)
+	}
+	return true
+}
+
+// Inject faults into traffic of the handler, or of handlers without faults of their own if it is `AllHandlers`.
+func (d *Dispatcher) SetFaults(handler string, f Faults) {
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+
+	d.faults[handler] = f
+	log.Warnf("Dispatcher: injecting faults into %s: %+v", handler, f)
+}
+
+func (d *Dispatcher) ClearFaults(handler string) {
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+
+	delete(d.faults, handler)
+	log.Warnf("Dispatcher: no longer injecting faults into %s", handler)
+}
+
+type FaultStatus struct {
+	Handler string `json:"handler"`
+	Faults
+}
+
+func (d *Dispatcher) Faults() []FaultStatus {
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+
+	res := make([]FaultStatus, 0, len(d.faults))
+	for h, f := range d.faults {
+		res = append(res, FaultStatus{
+			Handler: h,
+			Faults:  f,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Handler < res[j].Handler
+	})
+	return res
+}
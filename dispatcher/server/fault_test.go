@@ -0,0 +1,24 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestParseFaults(t *testing.T) {
+	faults, err := ParseFaults("pku:drop_result=0.1,delay_rate=0.5,delay_ms=300; *:corrupt=0.01")
+	if err != nil {
+		t.Fatalf("Error parsing faults: %s", err.Error())
+	}
+	if f := faults["pku"]; f.DropResult != 0.1 || f.DelayRate != 0.5 || f.DelayMs != 300 || f.Corrupt != 0 {
+		t.Fatalf("Wrong faults of pku: %+v", f)
+	}
+	if f := faults[AllHandlers]; f.Corrupt != 0.01 {
+		t.Fatalf("Wrong faults of all handlers: %+v", f)
+	}
+
+	for _, v := range []string{"pku", "pku:corrupt", "pku:corrupt=2", "pku:explode=0.5", "pku:delay_ms=-1"} {
+		if _, err := ParseFaults(v); err != ErrInvalidFaults {
+			t.Fatalf("Invalid faults %q parsed", v)
+		}
+	}
+}
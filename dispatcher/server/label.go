@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Subtasks with a selector go to their own queue, named after the selector,
+// so that a satellite only pulls from queues whose selectors it satisfies.
+func labelledQueue(base string, sel dispatcher.Labels) string {
+	if len(sel) == 0 {
+		return base
+	}
+	return fmt.Sprintf("%s?%s", base, sel.String())
+}
+
+func subtaskQueue(s *dispatcher.Subtask) string {
+	return labelledQueue(queueName(s.Handler, s.Type), s.Selector)
+}
+
+// Whether any live satellite accepts the queue and satisfies sel.
+func (d *Dispatcher) satisfiable(base string, sel dispatcher.Labels) bool {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	for _, st := range d.satellites {
+		if st.alive() && st.accepts[base] && sel.Selects(st.labels) {
+			return true
+		}
+	}
+	return false
+}
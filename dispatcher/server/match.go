@@ -0,0 +1,220 @@
+package server
+
+import (
+	"container/list"
+	"context"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Subtasks of one operation with the same selector, oldest first. See `subtaskQueue`.
+type waitQueue struct {
+	name     string
+	handler  string
+	base     string // See `queueName`.
+	selector dispatcher.Labels
+	list     *list.List // Of *pendingSubtask
+}
+
+// A satellite polling for a subtask.
+type puller struct {
+	satellite string
+	accepts   map[string]bool // Queues it accepts, see `queueName`.
+	labels    dispatcher.Labels
+	deliver   chan *dispatcher.Subtask // Buffered. Gets the subtask leased, or nil once the poll ends.
+	elem      *list.Element            // In d.pullers. Nil if it is not waiting.
+}
+
+func (pl *puller) takes(s *dispatcher.Subtask) bool {
+	return pl.accepts[queueName(s.Handler, s.Type)] && s.Selector.Selects(pl.labels)
+}
+
+// Lease p to the puller, who gets it from its deliver channel.
+// Called with d.mu held.
+func (d *Dispatcher) leaseLocked(p *pendingSubtask, pl *puller) {
+	d.unqueueLocked(p)
+	if pl.elem != nil {
+		d.pullers.Remove(pl.elem)
+		pl.elem = nil
+	}
+	p.satellite = pl.satellite
+	pl.deliver <- p.subtask
+}
+
+// Hand p to the puller waiting the longest that takes it, or queue it if there is none.
+// Called with d.mu held.
+func (d *Dispatcher) offerLocked(p *pendingSubtask) {
+	s := p.subtask
+	if !d.paused[s.Handler] {
+		for e := d.pullers.Front(); e != nil; e = e.Next() {
+			pl := e.Value.(*puller)
+			if d.takesLocked(pl, s) {
+				d.leaseLocked(p, pl)
+				return
+			}
+		}
+	}
+
+	name := subtaskQueue(s)
+	q, ok := d.queue[name]
+	if !ok {
+		q = &waitQueue{
+			name:     name,
+			handler:  s.Handler,
+			base:     queueName(s.Handler, s.Type),
+			selector: s.Selector,
+			list:     list.New(),
+		}
+		d.queue[name] = q
+	}
+	p.elem = q.list.PushBack(p)
+	p.queued = name
+	p.sticky = false
+}
+
+// Queue p for the satellite it has affinity with only.
+// Called with d.mu held.
+func (d *Dispatcher) offerStickyLocked(p *pendingSubtask, satellite string) {
+	l, ok := d.sticky[satellite]
+	if !ok {
+		l = list.New()
+		d.sticky[satellite] = l
+	}
+	p.elem = l.PushBack(p)
+	p.queued = satellite
+	p.sticky = true
+}
+
+// Take p out of whatever queue it waits in.
+// Called with d.mu held.
+func (d *Dispatcher) unqueueLocked(p *pendingSubtask) {
+	if p.elem == nil {
+		return
+	}
+	if p.sticky {
+		l := d.sticky[p.queued]
+		l.Remove(p.elem)
+		if l.Len() == 0 {
+			delete(d.sticky, p.queued)
+		}
+		if p.fallback != nil {
+			p.fallback.Stop()
+			p.fallback = nil
+		}
+	} else {
+		// Selectors are many, so empty queues do not stay.
+		q := d.queue[p.queued]
+		q.list.Remove(p.elem)
+		if q.list.Len() == 0 {
+			delete(d.queue, p.queued)
+		}
+	}
+	p.elem = nil
+}
+
+// The subtask the puller should take now, if any: the oldest one waiting for its satellite,
+// or else the oldest one among the queues it could pull from. Subtasks of paused handlers are left alone.
+// Called with d.mu held.
+func (d *Dispatcher) takeLocked(pl *puller) *pendingSubtask {
+	if l, ok := d.sticky[pl.satellite]; ok {
+		for e := l.Front(); e != nil; {
+			p := e.Value.(*pendingSubtask)
+			e = e.Next()
+			if d.paused[p.subtask.Handler] {
+				continue
+			}
+			if d.takesLocked(pl, p.subtask) {
+				return p
+			}
+			// The satellite no longer accepts it, or is quarantined.
+			d.unqueueLocked(p)
+			p.released = true
+			d.offerLocked(p)
+		}
+	}
+
+	var best *pendingSubtask
+	for _, q := range d.queue {
+		if q.list.Len() == 0 || d.paused[q.handler] || !pl.accepts[q.base] || !q.selector.Selects(pl.labels) ||
+			d.quarantinedLocked(pl.satellite, q.handler) {
+			continue
+		}
+		p := q.list.Front().Value.(*pendingSubtask)
+		if best == nil || p.pushed.Before(best.pushed) {
+			best = p
+		}
+	}
+	return best
+}
+
+// Match pullers waiting with subtasks queued, e.g. after a handler is resumed.
+// Called with d.mu held.
+func (d *Dispatcher) matchLocked() {
+	waiting := make([]*puller, 0, d.pullers.Len())
+	for e := d.pullers.Front(); e != nil; e = e.Next() {
+		waiting = append(waiting, e.Value.(*puller))
+	}
+	for _, pl := range waiting {
+		if pl.elem == nil {
+			// Got one meanwhile
+			continue
+		}
+		if p := d.takeLocked(pl); p != nil {
+			d.leaseLocked(p, pl)
+		}
+	}
+}
+
+// Stop waiting for subtasks. The puller gets nil unless it has got a subtask.
+func (d *Dispatcher) dropPuller(pl *puller) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if pl.elem != nil {
+		d.pullers.Remove(pl.elem)
+		pl.elem = nil
+		pl.deliver <- nil
+	}
+}
+
+// accepts are names of queues, see `queueName`.
+// Waits until a subtask the satellite could take comes, the pull timeout passes, or ctx is done.
+// The subtask returned is leased to satellite.
+func (d *Dispatcher) pullSubtask(ctx context.Context, satellite string, accepts []string, labels dispatcher.Labels) (*dispatcher.Subtask, error) {
+	pl := &puller{
+		satellite: satellite,
+		accepts:   make(map[string]bool),
+		labels:    labels,
+		deliver:   make(chan *dispatcher.Subtask, 1),
+	}
+	for _, v := range accepts {
+		pl.accepts[v] = true
+	}
+
+	var timeout *wheelTimer
+	d.mu.Lock()
+	if p := d.takeLocked(pl); p != nil {
+		d.leaseLocked(p, pl)
+	} else {
+		pl.elem = d.pullers.PushBack(pl)
+		timeout = d.wheel.AfterFunc(d.settings.PullTimeout, func() {
+			d.dropPuller(pl)
+		})
+	}
+	d.mu.Unlock()
+
+	var s *dispatcher.Subtask
+	select {
+	case s = <-pl.deliver:
+	case <-ctx.Done():
+		d.dropPuller(pl)
+		s = <-pl.deliver
+	}
+	if timeout != nil {
+		timeout.Stop()
+	}
+	if s == nil {
+		return nil, ErrTimeout
+	}
+	return s, nil
+}
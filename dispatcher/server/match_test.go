@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+const (
+	opBench   dispatcher.SubtaskType = "bench"
+	opTimeout dispatcher.SubtaskType = "bench_timeout"
+)
+
+func init() {
+	dispatcher.RegisterOperation("bench", dispatcher.Operation{Name: opBench, Timeout: time.Minute})
+	dispatcher.RegisterOperation("bench", dispatcher.Operation{Name: opTimeout, Timeout: 50 * time.Millisecond})
+}
+
+// What /put_result does once the result is decrypted.
+func complete(d *Dispatcher, id int64, r *dispatcher.SubtaskResult) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.pending[id]
+	if !ok {
+		return false
+	}
+	return d.finishLocked(p, r)
+}
+
+// Satellites pulling and completing subtasks until ctx is done.
+func runSatellites(ctx context.Context, d *Dispatcher, n int) *sync.WaitGroup {
+	accepts := []string{queueName("bench", opBench)}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				s, err := d.pullSubtask(ctx, "bench-satellite", accepts, nil)
+				if err != nil {
+					continue
+				}
+				complete(d, s.ID, &dispatcher.SubtaskResult{
+					Version: 1,
+					Status:  dispatcher.StatusOK,
+				})
+			}
+		}()
+	}
+	return &wg
+}
+
+func TestMatchConcurrent(t *testing.T) {
+	d := NewDispatcher(1<<16, []string{"bench"})
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := runSatellites(ctx, d, 8)
+
+	var ok, cancelled int32
+	var pushers sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		pushers.Add(1)
+		go func(i int) {
+			defer pushers.Done()
+			for j := 0; j < 200; j++ {
+				s := &dispatcher.Subtask{Handler: "bench", Type: opBench}
+				ch := d.PushSubtask(s)
+				if (i+j)%5 == 0 {
+					d.Cancel(s.ID)
+				}
+				r := <-ch
+				switch {
+				case r.Error == ErrCancelled:
+					atomic.AddInt32(&cancelled, 1)
+				case r.Error == nil && r.Status == dispatcher.StatusOK:
+					atomic.AddInt32(&ok, 1)
+				default:
+					t.Errorf("Unexpected result: %v %v", r.Status, r.Error)
+				}
+			}
+		}(i)
+	}
+	pushers.Wait()
+	cancel()
+	wg.Wait()
+
+	if ok+cancelled != 16*200 {
+		t.Fatalf("%d results, %d expected", ok+cancelled, 16*200)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.pending) != 0 || len(d.tags) != 0 || d.pullers.Len() != 0 {
+		t.Fatalf("Leftovers: %d pending, %d tags, %d pullers", len(d.pending), len(d.tags), d.pullers.Len())
+	}
+	if len(d.queue) != 0 || len(d.sticky) != 0 {
+		t.Fatalf("Leftovers: %d queues, %d sticky queues", len(d.queue), len(d.sticky))
+	}
+}
+
+func TestRevokedExpire(t *testing.T) {
+	d := NewDispatcher(1024, []string{"bench"})
+	d.mu.Lock()
+	d.revokeLocked("gone", &dispatcher.Subtask{ID: 1, Deadline: time.Now().Add(50 * time.Millisecond)})
+	d.revokeLocked("alive", &dispatcher.Subtask{ID: 2, Deadline: time.Now().Add(time.Hour)})
+	d.mu.Unlock()
+
+	if ids := d.takeRevoked("alive"); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("Wrong IDs revoked: %v", ids)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if d.forgetRevoked(1) {
+		t.Fatalf("Revoked subtask not forgotten after its deadline")
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.revoked) != 0 {
+		t.Fatalf("Leftovers: %v", d.revoked)
+	}
+}
+
+func TestMatchOldestFirst(t *testing.T) {
+	d := NewDispatcher(1024, []string{"bench"})
+	first := &dispatcher.Subtask{Handler: "bench", Type: opBench}
+	d.PushSubtask(first)
+	second := &dispatcher.Subtask{Handler: "bench", Type: opBench, Selector: dispatcher.Labels{"network": "campus"}}
+	d.smu.Lock()
+	d.satellites["campus"] = &satelliteState{
+		polling: 1,
+		labels:  dispatcher.Labels{"network": "campus"},
+		accepts: map[string]bool{queueName("bench", opBench): true},
+	}
+	d.smu.Unlock()
+	d.PushSubtask(second)
+
+	accepts := []string{queueName("bench", opBench)}
+	labels := dispatcher.Labels{"network": "campus"}
+	for _, want := range []*dispatcher.Subtask{first, second} {
+		s, err := d.pullSubtask(context.Background(), "campus", accepts, labels)
+		if err != nil || s.ID != want.ID {
+			t.Fatalf("Subtasks are not pulled oldest first")
+		}
+	}
+}
+
+// Subtasks per second through push, pull and result, without HTTP and encryption.
+func BenchmarkDispatcherThroughput(b *testing.B) {
+	d := NewDispatcher(1<<20, []string{"bench"})
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := runSatellites(ctx, d, 64)
+
+	left := int64(b.N)
+	var pushers sync.WaitGroup
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < 256; i++ {
+		pushers.Add(1)
+		go func() {
+			defer pushers.Done()
+			for atomic.AddInt64(&left, -1) >= 0 {
+				r := d.RunSubtask(&dispatcher.Subtask{Handler: "bench", Type: opBench})
+				if r.Error != nil {
+					b.Errorf("Error running subtask: %s", r.Error.Error())
+					return
+				}
+			}
+		}()
+	}
+	pushers.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "subtasks/s")
+	b.StopTimer()
+	cancel()
+	wg.Wait()
+}
+
+// Subtasks per second timing out on the timer wheel, with no satellite.
+func BenchmarkDispatcherTimeouts(b *testing.B) {
+	d := NewDispatcher(1<<20, []string{"bench"})
+
+	chs := make([]<-chan *dispatcher.SubtaskResult, b.N)
+	b.ResetTimer()
+	start := time.Now()
+	for i := range chs {
+		chs[i] = d.PushSubtask(&dispatcher.Subtask{Handler: "bench", Type: opTimeout})
+	}
+	for _, ch := range chs {
+		if r := <-ch; r.Error != ErrTimeout {
+			b.Fatalf("Subtask does not time out: %v", r.Error)
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "subtasks/s")
+}
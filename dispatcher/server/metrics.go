@@ -0,0 +1,29 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// Counters of each dispatcher, e.g. "breaker_state/pku": "open", are published at /debug/vars
+// under a name of its own: "dispatcher" for the first one in the process, then "dispatcher-2" and so on.
+var publishMu sync.Mutex
+
+func publishMetrics() (string, *expvar.Map) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	name := "dispatcher"
+	for i := 2; expvar.Get(name) != nil; i++ {
+		name = fmt.Sprintf("dispatcher-%d", i)
+	}
+	m := new(expvar.Map).Init()
+	expvar.Publish(name, m)
+	return name, m
+}
+
+// Name of the counters of the dispatcher at /debug/vars.
+func (d *Dispatcher) MetricsName() string {
+	return d.metricsName
+}
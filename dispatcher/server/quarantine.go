@@ -0,0 +1,277 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Satellites failing far more than others of the same handler, e.g. because the school
+// throttles their IP, are quarantined: they get no subtasks of the handler for a while.
+// Each quarantine in a row lasts twice as long as the last one.
+// A satellite reporting `dispatcher.StatusBlocked` a few times in a row is quarantined at once.
+//
+// Unlike breakers, which stop a handler when the school system fails for everyone,
+// quarantine only applies to outliers.
+var (
+	// How many recent outcomes of a satellite for a handler are considered.
+	QuarantineWindow = 20
+
+	// A satellite is never quarantined for failures with fewer outcomes than this.
+	// Zero disables quarantine for failures. Blocked results still quarantine.
+	QuarantineMinRequests = 10
+
+	// A satellite is quarantined after this many blocked results in a row, whatever others do,
+	// so that a page taken as a ban page by mistake does not quarantine it.
+	QuarantineBlockedHits = 3
+
+	// A satellite is quarantined when the ratio of failures among its recent outcomes reaches this,
+	// and other satellites of the handler stay below it.
+	QuarantineFailureRatio = 0.8
+
+	// How long the first quarantine in a row lasts.
+	QuarantineBase = time.Minute
+
+	// Quarantines never last longer than this.
+	QuarantineMax = time.Hour
+)
+
+type QuarantineStatus struct {
+	Satellite string    `json:"satellite"`
+	Handler   string    `json:"handler"`
+	Until     time.Time `json:"until"`
+	Strikes   int       `json:"strikes"` // Quarantines in a row
+	Reason    string    `json:"reason"`
+	Requests  int       `json:"requests"` // Outcomes in the window
+	Failures  int       `json:"failures"` // Failures in the window
+}
+
+// Recent outcomes of a satellite for a handler. Guarded by d.mu.
+type satelliteHealth struct {
+	satellite string
+	handler   string
+	outcomes  []bool // Ring buffer of recent outcomes. True means failed.
+	next      int
+	failures  int
+	blocked   int       // Blocked results in a row
+	until     time.Time // Quarantined until
+	strikes   int
+	reason    string
+}
+
+func healthKey(satellite string, handler string) string {
+	return fmt.Sprintf("%s|%s", satellite, handler)
+}
+
+func (h *satelliteHealth) quarantined() bool {
+	return time.Now().Before(h.until)
+}
+
+func (h *satelliteHealth) reset() {
+	h.outcomes = nil
+	h.next = 0
+	h.failures = 0
+	h.blocked = 0
+}
+
+func (h *satelliteHealth) add(failed bool, window int) {
+	if len(h.outcomes) < window {
+		h.outcomes = append(h.outcomes, failed)
+	} else {
+		if h.outcomes[h.next] {
+			h.failures--
+		}
+		h.outcomes[h.next] = failed
+		h.next = (h.next + 1) % window
+	}
+	if failed {
+		h.failures++
+	}
+}
+
+func (h *satelliteHealth) failing(ratio float64) bool {
+	return float64(h.failures) >= ratio*float64(len(h.outcomes))
+}
+
+func (h *satelliteHealth) status() QuarantineStatus {
+	return QuarantineStatus{
+		Satellite: h.satellite,
+		Handler:   h.handler,
+		Until:     h.until,
+		Strikes:   h.strikes,
+		Reason:    h.reason,
+		Requests:  len(h.outcomes),
+		Failures:  h.failures,
+	}
+}
+
+// Called with d.mu held.
+func (d *Dispatcher) healthLocked(satellite string, handler string) *satelliteHealth {
+	key := healthKey(satellite, handler)
+	h, ok := d.health[key]
+	if !ok {
+		h = &satelliteHealth{
+			satellite: satellite,
+			handler:   handler,
+		}
+		d.health[key] = h
+	}
+	return h
+}
+
+// Whether the satellite should get no subtasks of the handler.
+// Called with d.mu held.
+func (d *Dispatcher) quarantinedLocked(satellite string, handler string) bool {
+	h, ok := d.health[healthKey(satellite, handler)]
+	return ok && h.quarantined()
+}
+
+// Whether the puller could take s now.
+// Called with d.mu held.
+func (d *Dispatcher) takesLocked(pl *puller, s *dispatcher.Subtask) bool {
+	return pl.takes(s) && !d.quarantinedLocked(pl.satellite, s.Handler)
+}
+
+// Whether the result tells something about the satellite, whether it failed, and whether it was blocked.
+// Failures of the school system count too, since they are compared with other satellites.
+func satelliteOutcomeOf(res *dispatcher.SubtaskResult) (bool, bool, bool) {
+	if res.Error != nil {
+		return res.Error == ErrTimeout, true, false
+	}
+	switch res.Status {
+	case dispatcher.StatusOK, dispatcher.StatusRejected, dispatcher.StatusSessionExpired:
+		return true, false, false
+	case dispatcher.StatusFailed:
+		return true, true, false
+	case dispatcher.StatusBlocked:
+		return true, true, true
+	}
+	return false, false, false
+}
+
+// Record the outcome of a subtask leased to the satellite.
+// Called with d.mu held.
+func (d *Dispatcher) recordHealthLocked(satellite string, handler string, res *dispatcher.SubtaskResult) {
+	counted, failed, blocked := satelliteOutcomeOf(res)
+	if !counted {
+		return
+	}
+	h := d.healthLocked(satellite, handler)
+	if h.quarantined() {
+		// Subtasks leased before the quarantine are ignored.
+		return
+	}
+	if !blocked {
+		h.blocked = 0
+	} else if h.blocked++; h.blocked >= d.settings.QuarantineBlockedHits {
+		d.quarantineLocked(h, 0, fmt.Sprintf("upstream blocked %d times in a row", h.blocked))
+		return
+	}
+
+	h.add(failed, d.settings.QuarantineWindow)
+	if len(h.outcomes) < d.settings.QuarantineMinRequests || d.settings.QuarantineMinRequests <= 0 {
+		return
+	}
+	if !h.failing(d.settings.QuarantineFailureRatio) {
+		// Healthy again since the last quarantine.
+		h.strikes = 0
+		return
+	}
+	if d.outlierLocked(h) {
+		d.quarantineLocked(h, 0, fmt.Sprintf("%d of %d recent subtasks failed", h.failures, len(h.outcomes)))
+	}
+}
+
+// Whether other satellites of the handler are doing fine, so that the school system is not to blame.
+// Called with d.mu held.
+func (d *Dispatcher) outlierLocked(h *satelliteHealth) bool {
+	var requests, failures int
+	for _, v := range d.health {
+		if v == h || v.handler != h.handler || v.quarantined() {
+			continue
+		}
+		requests += len(v.outcomes)
+		failures += v.failures
+	}
+	return requests >= d.settings.QuarantineMinRequests &&
+		float64(failures) < d.settings.QuarantineFailureRatio*float64(requests)
+}
+
+// Quarantine the satellite for the handler for dur, or exponentially by strikes if dur is zero.
+// Called with d.mu held.
+func (d *Dispatcher) quarantineLocked(h *satelliteHealth, dur time.Duration, reason string) {
+	if dur <= 0 {
+		h.strikes++
+		dur = d.settings.QuarantineBase
+		for i := 1; i < h.strikes && dur < d.settings.QuarantineMax; i++ {
+			dur *= 2
+		}
+		if dur > d.settings.QuarantineMax {
+			dur = d.settings.QuarantineMax
+		}
+	}
+	h.until = time.Now().Add(dur)
+	h.reason = reason
+	h.reset()
+	log.Warnf("Dispatcher: satellite %s quarantined for %s for %s: %s", h.satellite, h.handler, dur, reason)
+	d.metrics.Add(fmt.Sprintf("quarantines/%s", h.handler), 1)
+
+	// Let it pull again once released.
+	until := h.until
+	d.wheel.AfterFunc(dur, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if h.until.Equal(until) {
+			log.Infof("Dispatcher: satellite %s released from quarantine for %s", h.satellite, h.handler)
+		}
+		d.matchLocked()
+	})
+}
+
+// Satellites quarantined now, soonest released first.
+func (d *Dispatcher) Quarantines() []QuarantineStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	res := make([]QuarantineStatus, 0)
+	for _, h := range d.health {
+		if h.quarantined() {
+			res = append(res, h.status())
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Until.Before(res[j].Until)
+	})
+	return res
+}
+
+// Quarantine the satellite for the handler by hand.
+func (d *Dispatcher) Quarantine(satellite string, handler string, dur time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.quarantineLocked(d.healthLocked(satellite, handler), dur, "by admin")
+}
+
+// Release the satellite from quarantine for the handler, and forget its failures.
+// Returns false if it is not quarantined.
+func (d *Dispatcher) Release(satellite string, handler string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h, ok := d.health[healthKey(satellite, handler)]
+	if !ok || !h.quarantined() {
+		return false
+	}
+	h.until = time.Time{}
+	h.strikes = 0
+	h.reset()
+	log.Warnf("Dispatcher: satellite %s released from quarantine for %s by admin", satellite, handler)
+	d.matchLocked()
+	return true
+}
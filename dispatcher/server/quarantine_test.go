@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/applepi-icpc/icarus/dispatcher"
+)
+
+// Lease one subtask to the satellite and report status. Returns false if the satellite got none.
+func runOne(d *Dispatcher, satellite string, status dispatcher.ResultStatus) bool {
+	ch := d.PushSubtask(&dispatcher.Subtask{Handler: "bench", Type: opBench})
+	s, err := d.pullSubtask(context.Background(), satellite, []string{queueName("bench", opBench)}, nil)
+	if err != nil {
+		d.Drain("bench")
+		<-ch
+		return false
+	}
+	complete(d, s.ID, &dispatcher.SubtaskResult{
+		Version: 1,
+		Status:  status,
+	})
+	<-ch
+	return true
+}
+
+func TestQuarantine(t *testing.T) {
+	settings := DefaultSettings()
+	settings.PullTimeout = 100 * time.Millisecond
+	settings.QuarantineBase = 200 * time.Millisecond
+	d := NewDispatcherWithSettings(1024, []string{"bench"}, settings)
+	for i := 0; i < settings.QuarantineMinRequests; i++ {
+		runOne(d, "good", dispatcher.StatusOK)
+	}
+	for i := 0; i < settings.QuarantineMinRequests; i++ {
+		if !runOne(d, "bad", dispatcher.StatusFailed) {
+			t.Fatalf("Satellite quarantined too early")
+		}
+	}
+	qs := d.Quarantines()
+	if len(qs) != 1 || qs[0].Satellite != "bad" || qs[0].Handler != "bench" || qs[0].Strikes != 1 {
+		t.Fatalf("Failing satellite is not quarantined: %v", qs)
+	}
+	if runOne(d, "bad", dispatcher.StatusOK) {
+		t.Fatalf("Quarantined satellite got a subtask")
+	}
+	if !runOne(d, "good", dispatcher.StatusOK) {
+		t.Fatalf("Healthy satellite got no subtask")
+	}
+
+	// Released after a while. The next quarantine lasts longer.
+	time.Sleep(settings.QuarantineBase)
+	for i := 0; i < settings.QuarantineBlockedHits; i++ {
+		if !runOne(d, "bad", dispatcher.StatusBlocked) {
+			t.Fatalf("Satellite is not released, or quarantined by %d blocked results", i)
+		}
+	}
+	qs = d.Quarantines()
+	if len(qs) != 1 || qs[0].Strikes != 2 || time.Until(qs[0].Until) <= settings.QuarantineBase {
+		t.Fatalf("Blocked satellite is not quarantined for longer: %v", qs)
+	}
+
+	// Satellites without a way out tell nothing about the school.
+	if !d.Release("bad", "bench") {
+		t.Fatalf("Blocked satellite is not quarantined")
+	}
+	for i := 0; i < 2*settings.QuarantineMinRequests; i++ {
+		runOne(d, "bad", dispatcher.StatusUnavailable)
+	}
+	if qs := d.Quarantines(); len(qs) != 0 {
+		t.Fatalf("Satellite quarantined for having no proxy: %v", qs)
+	}
+	d.Quarantine("bad", "bench", time.Minute)
+
+	// Admin override
+	if !d.Release("bad", "bench") || d.Release("bad", "bench") {
+		t.Fatalf("Release reports wrongly")
+	}
+	if !runOne(d, "bad", dispatcher.StatusOK) {
+		t.Fatalf("Released satellite got no subtask")
+	}
+}
+
+func TestQuarantineEveryoneFailing(t *testing.T) {
+	settings := DefaultSettings()
+	settings.BreakerMinRequests = 0
+	d := NewDispatcherWithSettings(1024, []string{"bench"}, settings)
+	for i := 0; i < settings.QuarantineMinRequests; i++ {
+		runOne(d, "a", dispatcher.StatusFailed)
+		runOne(d, "b", dispatcher.StatusFailed)
+	}
+	// The school system is to blame, and the breaker takes care of it.
+	if qs := d.Quarantines(); len(qs) != 0 {
+		t.Fatalf("Satellites quarantined when all are failing: %v", qs)
+	}
+}
+
+func TestForgetIdle(t *testing.T) {
+	settings := DefaultSettings()
+	settings.SatelliteForget = 100 * time.Millisecond
+	d := NewDispatcherWithSettings(1024, []string{"bench"}, settings)
+	seen := func(satellite string) {
+		d.recordRefusals(satellite, []dispatcher.Refusal{{Handler: "bench", Operation: opBench, MinVersion: 1}})
+		d.satelliteArrived(satellite, nil, []string{queueName("bench", opBench)})
+		d.satelliteLeft(satellite)
+	}
+	seen("idle")
+	seen("jailed")
+	d.Quarantine("jailed", "bench", time.Minute)
+	d.mu.Lock()
+	d.healthLocked("idle", "bench")
+	d.mu.Unlock()
+
+	time.Sleep(settings.SatelliteForget)
+	seen("busy")
+	d.forgetIdle()
+	if st := d.SatelliteConfigs(); len(st) != 1 || st[0].Satellite != "busy" {
+		t.Fatalf("Idle satellites are not forgotten: %+v", st)
+	}
+	if rs := d.RefusedSatellites(); len(rs) != 1 || rs[0].Satellite != "busy" {
+		t.Fatalf("Refusals of idle satellites are not forgotten: %+v", rs)
+	}
+	d.mu.RLock()
+	_, idle := d.health[healthKey("idle", "bench")]
+	_, jailed := d.health[healthKey("jailed", "bench")]
+	d.mu.RUnlock()
+	if idle || !jailed {
+		t.Fatalf("Wrong health kept: idle %t, quarantined %t", idle, jailed)
+	}
+}
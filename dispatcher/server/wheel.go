@@ -0,0 +1,118 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	wheelTick  = 10 * time.Millisecond
+	wheelSlots = 512
+)
+
+// Hashed timer wheel shared by all timeouts of a dispatcher: subtask timeouts,
+// affinity fallbacks and polls, so that thousands of subtasks in flight cost
+// a slot entry each rather than a goroutine and a runtime timer each.
+//
+// Timers never fire early, and fire at most one tick late unless callbacks are slow.
+// Callbacks run one by one on the goroutine of the wheel, which only runs while timers are set.
+type timerWheel struct {
+	mu      sync.Mutex
+	slots   [wheelSlots][]*wheelTimer
+	start   time.Time
+	now     int64 // Ticks since start that have been processed
+	count   int   // Timers set and not fired or stopped
+	running bool
+}
+
+type wheelTimer struct {
+	w    *timerWheel
+	at   int64 // Tick to fire on
+	f    func()
+	done bool // Fired or stopped
+}
+
+// Call f after at least d.
+func (w *timerWheel) AfterFunc(d time.Duration, f func()) *wheelTimer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.running {
+		w.running = true
+		w.start = time.Now()
+		w.now = 0
+		go w.run()
+	}
+
+	at := int64((time.Since(w.start) + d + wheelTick - 1) / wheelTick)
+	if at <= w.now {
+		at = w.now + 1
+	}
+	t := &wheelTimer{
+		w:  w,
+		at: at,
+		f:  f,
+	}
+	slot := at % wheelSlots
+	w.slots[slot] = append(w.slots[slot], t)
+	w.count++
+	return t
+}
+
+// Returns false if the timer has fired or been stopped.
+// The callback may still run afterwards if it was about to, so callbacks check for themselves.
+func (t *wheelTimer) Stop() bool {
+	t.w.mu.Lock()
+	defer t.w.mu.Unlock()
+
+	if t.done {
+		return false
+	}
+	t.done = true
+	t.w.count--
+	return true
+}
+
+func (w *timerWheel) run() {
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.mu.Lock()
+		due := make([]func(), 0)
+		target := int64(time.Since(w.start) / wheelTick)
+		for w.now < target {
+			w.now++
+			slot := w.now % wheelSlots
+			left := w.slots[slot][:0]
+			for _, t := range w.slots[slot] {
+				switch {
+				case t.done:
+					// Stopped
+				case t.at <= w.now:
+					t.done = true
+					w.count--
+					due = append(due, t.f)
+				default:
+					left = append(left, t)
+				}
+			}
+			for i := len(left); i < len(w.slots[slot]); i++ {
+				w.slots[slot][i] = nil
+			}
+			w.slots[slot] = left
+		}
+		idle := w.count == 0
+		if idle {
+			w.running = false
+		}
+		w.mu.Unlock()
+
+		for _, f := range due {
+			f()
+		}
+		if idle {
+			return
+		}
+	}
+}
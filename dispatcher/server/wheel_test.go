@@ -0,0 +1,60 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	var w timerWheel
+
+	var mu sync.Mutex
+	late := make(map[time.Duration]time.Duration)
+	var wg sync.WaitGroup
+	for _, d := range []time.Duration{0, 15 * time.Millisecond, 120 * time.Millisecond, wheelTick * (wheelSlots + 3)} {
+		wg.Add(1)
+		d := d
+		start := time.Now()
+		w.AfterFunc(d, func() {
+			defer wg.Done()
+			mu.Lock()
+			late[d] = time.Since(start) - d
+			mu.Unlock()
+		})
+	}
+	stopped := w.AfterFunc(50*time.Millisecond, func() {
+		t.Errorf("Stopped timer fired")
+	})
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatalf("Timer stops more than once")
+	}
+	wg.Wait()
+
+	for d, v := range late {
+		if v < 0 {
+			t.Fatalf("Timer of %s fired %s early", d, -v)
+		}
+		if v > 10*wheelTick {
+			t.Fatalf("Timer of %s fired %s late", d, v)
+		}
+	}
+
+	// The wheel stops running once idle, and starts again.
+	time.Sleep(5 * wheelTick)
+	w.mu.Lock()
+	running := w.running
+	w.mu.Unlock()
+	if running {
+		t.Fatalf("Idle wheel keeps running")
+	}
+	done := make(chan struct{})
+	w.AfterFunc(wheelTick, func() {
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Wheel does not start again")
+	}
+}
@@ -0,0 +1,40 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tags group subtasks, so that they could be cancelled together,
+// e.g. all subtasks of task 17 are tagged with `TaskTag(17)`.
+
+func TaskTag(id int) string {
+	return fmt.Sprintf("task:%d", id)
+}
+
+type keyType int
+
+const keyTags keyType = iota
+
+// Subtasks issued under the returned context are tagged with tags, and with those already in ctx.
+func WithTags(ctx context.Context, tags ...string) context.Context {
+	old := TagsFromContext(ctx)
+	res := make([]string, 0, len(old)+len(tags))
+	res = append(res, old...)
+	res = append(res, tags...)
+	return context.WithValue(ctx, keyTags, res)
+}
+
+func TagsFromContext(ctx context.Context) []string {
+	if ctx == nil {
+		return nil
+	}
+	tags, _ := ctx.Value(keyTags).([]string)
+	return tags
+}
+
+// Subtasks sharing a login session of the user on the handler share this affinity key,
+// so that they run on the same satellite, with the same egress IP.
+func AffinityKey(handler string, userID string) string {
+	return fmt.Sprintf("%s:%s", handler, userID)
+}
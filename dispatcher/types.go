@@ -1,29 +1,118 @@
 package dispatcher
 
-type SubtaskType int
+import (
+	"encoding/json"
+	"time"
 
-const (
-	SubtaskLogin SubtaskType = iota
-	SubtaskList
-	SubtaskElect
+	"github.com/applepi-icpc/icarus/trace"
 )
 
 type Subtask struct {
 	Handler string      `json:"handler"`
 	Type    SubtaskType `json:"type"`
-	Data    []string    `json:"data"`
+
+	// Protocol version of Payload. See `ProtocolVersion`.
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Positional arguments of the legacy protocol (version 0).
+	// Still filled by clients so that older satellites keep working.
+	Data []string `json:"data,omitempty"`
 
 	// Leave it empty and pass Subtask to dispatcher, and it will generate a random ID.
 	ID int64 `json:"id"`
+
+	// Set by dispatcher from the timeout of the operation. Nobody waits for
+	// the result after it, so satellites should not start or keep working on it.
+	// Zero means no deadline (legacy servers).
+	//
+	// It is on the server's clock. Satellites, whose clocks may be off, go by TTLMs
+	// instead, see `Localize`.
+	Deadline time.Time `json:"deadline"`
+
+	// Milliseconds left until the deadline when the server handed the subtask out.
+	// Zero if there is no deadline, or the server is a legacy one.
+	TTLMs int64 `json:"ttl_ms,omitempty"`
+
+	// Subtasks with the same affinity key prefer the satellite that last ran one of them
+	// successfully, e.g. the one that logged in. See `AffinityKey`.
+	Affinity string `json:"affinity,omitempty"`
+
+	// Only satellites having all these labels could run it.
+	// Merged with the selector of the operation. See `Operation`.
+	Selector Labels `json:"selector,omitempty"`
+
+	// Subtasks could be cancelled by tag. See `TaskTag`.
+	Tags []string `json:"tags,omitempty"`
+
+	// Span of whoever issued this subtask. The dispatcher and satellites continue the trace from it.
+	Trace trace.SpanContext `json:"trace"`
+}
+
+// Capability of a satellite on one handler.
+type Capability struct {
+	Handler string `json:"handler"`
+
+	// Version of the satellite's worker for this handler.
+	WorkerVersion int `json:"worker_version"`
+
+	// Operations the worker supports.
+	Operations []SubtaskType `json:"operations"`
 }
 
 type TaskRequest struct {
+	// Name of the satellite.
+	Satellite string `json:"satellite"`
+
 	// Handlers that accepts.
 	// If multiple handlers are indicated, separate them with comma (",").
+	// Dispatchers ignore it when Capabilities is present.
 	Accepts string `json:"accepts"`
 
+	// Legacy satellites leave it empty, and are taken as version 0 workers
+	// of the accepted handlers, supporting only login, list and elect.
+	Capabilities []Capability `json:"capabilities,omitempty"`
+
+	// Labels of the satellite, e.g. network=campus. See `Subtask.Selector`.
+	Labels Labels `json:"labels,omitempty"`
+
 	// Base64 encoded binary cipher.
 	Cipher string `json:"cipher"`
+
+	// ID of the public key the cipher was encrypted with, see `KeyID`.
+	// Legacy satellites leave it empty, and the primary key of the server is used.
+	KeyID string `json:"key_id,omitempty"`
+
+	// Version of the configuration the satellite runs, see `SatelliteProfile`.
+	// Empty if it has got none.
+	ConfigVersion string `json:"config_version,omitempty"`
+}
+
+// Sent by satellites to check they could talk with the server, e.g. in a self test.
+type HandshakeRequest struct {
+	Satellite string `json:"satellite"`
+
+	// As in `TaskRequest`.
+	Cipher string `json:"cipher"`
+	KeyID  string `json:"key_id,omitempty"`
+
+	// Random text the server encrypts with the key in Cipher.
+	Challenge string `json:"challenge"`
+}
+
+type HandshakeResponse struct {
+	// Challenge encrypted, proving the server holds the private key of the satellite's public key.
+	Content string `json:"content"`
+
+	ProtocolVersion int `json:"protocol_version"`
+}
+
+// An operation the dispatcher would not give to the satellite because its worker is too old.
+type Refusal struct {
+	Handler       string      `json:"handler"`
+	Operation     SubtaskType `json:"operation"`
+	WorkerVersion int         `json:"worker_version"`
+	MinVersion    int         `json:"min_version"`
 }
 
 type TaskResponse struct {
@@ -32,11 +121,51 @@ type TaskResponse struct {
 
 	// Encrypted Subtask, encoded in Base64.
 	Content string `json:"content"`
+
+	// Operations refused to this satellite. Upgrade the worker to get them.
+	Refused []Refusal `json:"refused,omitempty"`
+
+	// IDs of subtasks leased to this satellite that have been cancelled since.
+	// Abort them, and do not send their results back.
+	Cancelled []int64 `json:"cancelled,omitempty"`
+
+	// How busy the server is, for satellites to scale their routines.
+	Backlog *Backlog `json:"backlog,omitempty"`
+
+	// The configuration of the satellite if it runs another version: `SatelliteProfile`
+	// encrypted as Content is, since proxies in it may carry credentials.
+	Config string `json:"config,omitempty"`
+}
+
+// Hints for satellites on how often to poll. Legacy servers send none.
+type Backlog struct {
+	// Subtasks waiting that the satellite could take. Poll again at once while there are some.
+	QueueDepth int `json:"queue_depth"`
+
+	// How long each routine should wait between polls when nothing is waiting,
+	// at least. Zero means the satellite decides.
+	PollIntervalMs int `json:"poll_interval_ms,omitempty"`
+
+	// Do not poll before this, e.g. when every handler accepted is paused.
+	// Also sent as the Retry-After header, in seconds.
+	RetryAfterMs int `json:"retry_after_ms,omitempty"`
 }
 
 type SubtaskResult struct {
-	Data  []string `json:"data"`
-	Error error    `json:"-"` // This member will be set by dispatcher if things go wrong.
+	// Version 0 means the result came from a legacy worker, and only Data is set.
+	Version int             `json:"version"`
+	Status  ResultStatus    `json:"status"`
+	Code    string          `json:"code,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Where the worker panicked, if Code is `CodeWorkerCrashed`.
+	Stack string `json:"stack,omitempty"`
+
+	// Positional result of the legacy protocol (version 0).
+	Data []string `json:"data,omitempty"`
+
+	Error error `json:"-"` // This member will be set by dispatcher if things go wrong.
 }
 
 type WorkResponse struct {
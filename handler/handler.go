@@ -3,12 +3,15 @@ package handler
 import (
 	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/applepi-icpc/icarus"
 	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/dispatcher"
 	"github.com/applepi-icpc/icarus/dispatcher/server"
 	"github.com/applepi-icpc/icarus/task"
 	"github.com/applepi-icpc/icarus/task/manager"
@@ -26,6 +29,15 @@ const SessionName = "icarus-session"
 
 var store *sessions.CookieStore
 
+// Handler serves the API. Subtasks of its tasks go to its dispatcher,
+// which is also the one managed by `/dispatcher/*`.
+type Handler struct {
+	disp  *server.Dispatcher
+	tasks *manager.Manager
+
+	handler http.Handler
+}
+
 var (
 	flagCookieSecret = flag.String("cookie", "grimoire-of-alice", "Cookie secret")
 	flagEdgeUser     = flag.String("id", "edge", "Username of superuser")
@@ -134,6 +146,21 @@ func ParseHandle(allowEmpty bool) kami.Middleware {
 		return context.WithValue(newCtx, keyHandle, cli)
 	}
 }
+
+// Same as `ParseHandle(false)`, but also accepts `server.AllHandlers`.
+func ParseFaultHandle(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	var h string
+	err := GetJSONKeyAs(ctx, "handle", &h)
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, BadField("handle"))
+		return nil
+	}
+	if h == server.AllHandlers {
+		return context.WithValue(ctx, keyHandleName, h)
+	}
+	return ParseHandle(false)(ctx, w, r)
+}
+
 func GetHandleName(ctx context.Context) string {
 	return ctx.Value(keyHandleName).(string)
 }
@@ -142,7 +169,7 @@ func GetHandle(ctx context.Context) client.Client {
 }
 
 // After `ParseHandle`
-func ParseUser(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+func (h *Handler) ParseUser(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
 	var ud icarus.UserData
 	err := GetJSONKeyAs(ctx, "user", &ud)
 	if err != nil {
@@ -150,7 +177,7 @@ func ParseUser(ctx context.Context, w http.ResponseWriter, r *http.Request) cont
 		return nil
 	}
 	cli := GetHandle(ctx)
-	u, err := client.MakeUserByData(cli, ud)
+	u, err := client.MakeUserByData(cli, h.disp, ud)
 	if err != nil {
 		WriteJSON(w, http.StatusBadRequest, BadMake("user"))
 		return nil
@@ -165,7 +192,7 @@ func GetUserData(ctx context.Context) icarus.UserData {
 	return ctx.Value(keyUserData).(icarus.UserData)
 }
 
-func ParseTaskID(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+func (h *Handler) ParseTaskID(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
 	var ID int
 	err := GetJSONKeyAs(ctx, "id", &ID)
 	if err != nil {
@@ -174,7 +201,7 @@ func ParseTaskID(ctx context.Context, w http.ResponseWriter, r *http.Request) co
 	}
 
 	// authenticate
-	taskdata, err := manager.GetTaskData(ID)
+	taskdata, err := h.tasks.GetTaskData(ID)
 	if err != nil {
 		WriteJSON(w, http.StatusNotFound, NotFound)
 		return nil
@@ -199,7 +226,7 @@ func ParseTaskID(ctx context.Context, w http.ResponseWriter, r *http.Request) co
 	}
 
 	// get real task
-	t, err := manager.GetTask(ID)
+	t, err := h.tasks.GetTask(ID)
 	if err != nil {
 		WriteJSON(w, http.StatusNotFound, NotFound)
 		return nil
@@ -214,7 +241,7 @@ func GetTaskID(ctx context.Context) int {
 	return ctx.Value(keyTaskID).(int)
 }
 
-func ParseAllTaskData(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+func (h *Handler) ParseAllTaskData(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
 	session, err := store.Get(r, SessionName)
 	if err != nil {
 		log.Errorf("Frontend: Failed to save session: %s", err.Error())
@@ -228,7 +255,7 @@ func ParseAllTaskData(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	}
 	handle, _ := session.Values["handle"]
 
-	raw := manager.ListTasksData()
+	raw := h.tasks.ListTasksData()
 	if userid == *flagEdgeUser {
 		return context.WithValue(ctx, keyAllTaskData, raw)
 	} else {
@@ -245,15 +272,15 @@ func GetAllTaskData(ctx context.Context) []icarus.TaskData {
 	return ctx.Value(keyAllTaskData).([]icarus.TaskData)
 }
 
-func ParseAllTask(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
-	ctx = ParseAllTaskData(ctx, w, r)
+func (h *Handler) ParseAllTask(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	ctx = h.ParseAllTaskData(ctx, w, r)
 	if ctx == nil {
 		return nil
 	}
 	td := GetAllTaskData(ctx)
 	res := make([]*task.Task, 0)
 	for _, v := range td {
-		t, err := manager.GetTask(v.ID)
+		t, err := h.tasks.GetTask(v.ID)
 		if err != nil {
 			log.Warnf("Frontend: Task %d vanished when retriving.", v.ID)
 			continue
@@ -287,7 +314,12 @@ func AuthEdgeUser(ctx context.Context, w http.ResponseWriter, r *http.Request) c
 
 // Do actual work
 
-func InitHandler() {
+// Make a handler, whose tasks are in m, and whose subtasks go to d.
+func NewHandler(d *server.Dispatcher, m *manager.Manager) *Handler {
+	h := &Handler{
+		disp:  d,
+		tasks: m,
+	}
 	router := httprouter.New()
 	amaterasu := kami.New(context.Background, router)
 	store = sessions.NewCookieStore([]byte(*flagCookieSecret))
@@ -297,6 +329,7 @@ func InitHandler() {
 	// Login
 	// - Form: handle, userid, password
 	//		(if userid == "edge", `handle` is not needed)
+	//		(password could be sealed to the worker key of the handle, see `/worker_key`)
 	// - Return: okay / error
 	amaterasu.With(ParseHandle(true)).Post("/login", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		var userid, password string
@@ -322,12 +355,12 @@ func InitHandler() {
 				WriteJSON(w, http.StatusBadRequest, BadField("handle"))
 				return
 			}
-			u, err := cli.MakeUser(userid, password)
+			u, err := cli.MakeUser(h.disp, userid, password)
 			if err != nil {
 				WriteJSON(w, http.StatusBadRequest, BadMake("user"))
 				return
 			}
-			_, err = u.Login()
+			_, err = u.Login(ctx)
 			if err != nil {
 				if err == server.ErrFailedToLogin {
 					WriteJSON(w, http.StatusForbidden, Forbidden)
@@ -350,12 +383,27 @@ func InitHandler() {
 		}
 	})
 
+	// Worker key of a handle, to seal passwords to before sending them
+	// - Form: handle
+	// - Return: {key_id, public_key (PEM)} / error
+	amaterasu.With(ParseHandle(false)).Post("/worker_key", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		id, pub, err := client.WorkerPublicKey(GetHandleName(ctx))
+		if err != nil {
+			WriteJSON(w, http.StatusNotFound, NotFound)
+			return
+		}
+		WriteJSON(w, http.StatusOK, M{
+			"key_id":     id,
+			"public_key": string(pub),
+		})
+	})
+
 	// List courses
 	// - Form: handle, User
 	// - Return: []CourseData / error
-	amaterasu.With(AuthEdgeUser).With(ParseHandle(false)).With(ParseUser).Post("/list_courses", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(AuthEdgeUser).With(ParseHandle(false)).With(h.ParseUser).Post("/list_courses", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		u := GetUser(ctx)
-		courses, err := u.ListCourse()
+		courses, err := u.ListCourse(ctx)
 		if err != nil {
 			if err == server.ErrInvalidData {
 				WriteJSON(w, http.StatusInternalServerError, InternalError)
@@ -371,7 +419,7 @@ func InitHandler() {
 	// - Return: []TaskData / error
 	// -- omit User.Password
 	// -- omit Course.Token
-	amaterasu.With(ParseAllTaskData).Post("/list_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseAllTaskData).Post("/list_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		td := GetAllTaskData(ctx)
 		for k, _ := range td {
 			for kk, _ := range td[k].Courses {
@@ -385,7 +433,7 @@ func InitHandler() {
 	// Create task
 	// - Form: handle, User, []Course
 	// - Return: id / error
-	amaterasu.With(ParseHandle(false)).With(ParseUser).Post("/create_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(ParseHandle(false)).With(h.ParseUser).Post("/create_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		ud := GetUserData(ctx)
 
 		var cd []icarus.CourseData
@@ -400,7 +448,7 @@ func InitHandler() {
 			User:    ud,
 			Courses: cd,
 		}
-		id, t, err := manager.CreateTask(td)
+		id, t, err := h.tasks.CreateTask(td)
 		if err != nil {
 			log.Warnf("Frontend: Error creating task: %s", err.Error())
 			WriteJSON(w, http.StatusInternalServerError, InternalError)
@@ -418,7 +466,7 @@ func InitHandler() {
 	// Start task
 	// - Form: id
 	// - Return: okay / error
-	amaterasu.With(ParseTaskID).Post("/start_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseTaskID).Post("/start_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		t := GetTask(ctx)
 		t.Start()
 		WriteJSON(w, http.StatusOK, OK)
@@ -426,7 +474,7 @@ func InitHandler() {
 
 	// Stop task
 	// ...
-	amaterasu.With(ParseTaskID).Post("/stop_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseTaskID).Post("/stop_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		t := GetTask(ctx)
 		t.Stop()
 		WriteJSON(w, http.StatusOK, OK)
@@ -434,7 +482,7 @@ func InitHandler() {
 
 	// Restart task
 	// ...
-	amaterasu.With(ParseTaskID).Post("/restart_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseTaskID).Post("/restart_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		t := GetTask(ctx)
 		t.Restart()
 		WriteJSON(w, http.StatusOK, OK)
@@ -442,9 +490,9 @@ func InitHandler() {
 
 	// Delete task
 	// ...
-	amaterasu.With(ParseTaskID).Post("/delete_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseTaskID).Post("/delete_task", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		ID := GetTaskID(ctx)
-		err := manager.DeleteTask(ID)
+		err := h.tasks.DeleteTask(ID)
 		if err != nil {
 			if err == manager.ErrNotFound {
 				WriteJSON(w, http.StatusNotFound, NotFound)
@@ -459,7 +507,7 @@ func InitHandler() {
 
 	// Start all tasks
 	// - Return: okay / error
-	amaterasu.With(ParseAllTask).Post("/start_all", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseAllTask).Post("/start_all", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		t := GetAllTask(ctx)
 		for _, v := range t {
 			v.Start()
@@ -469,7 +517,7 @@ func InitHandler() {
 
 	// Stop all tasks
 	// ...
-	amaterasu.With(ParseAllTask).Post("/stop_all", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseAllTask).Post("/stop_all", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		t := GetAllTask(ctx)
 		for _, v := range t {
 			v.Stop()
@@ -479,7 +527,7 @@ func InitHandler() {
 
 	// Restart all tasks
 	// ...
-	amaterasu.With(ParseAllTask).Post("/restart_all", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseAllTask).Post("/restart_all", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		t := GetAllTask(ctx)
 		for _, v := range t {
 			v.Restart()
@@ -489,11 +537,11 @@ func InitHandler() {
 
 	// Delete all tasks
 	// ...
-	amaterasu.With(ParseAllTaskData).Post("/delete_all", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	amaterasu.With(h.ParseAllTaskData).Post("/delete_all", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		t := GetAllTaskData(ctx)
 		for _, v := range t {
 			ID := v.ID
-			err := manager.DeleteTask(ID)
+			err := h.tasks.DeleteTask(ID)
 			if err != nil {
 				if err == manager.ErrNotFound {
 					WriteJSON(w, http.StatusNotFound, NotFound)
@@ -507,5 +555,222 @@ func InitHandler() {
 		WriteJSON(w, http.StatusOK, OK)
 	})
 
-	http.Handle("/", amaterasu.Handler())
+	// Dispatcher administration, for edge user only.
+	admin := amaterasu.With(AuthEdgeUser)
+
+	// List queues
+	// - Return: []QueueStatus
+	admin.Post("/dispatcher/queues", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.Queues())
+	})
+
+	// Peek pending subtasks, with credentials redacted
+	// - Form: handle (optional)
+	// - Return: []PendingStatus
+	admin.With(ParseHandle(true)).Post("/dispatcher/pending", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.PendingSubtasks(GetHandleName(ctx)))
+	})
+
+	// Pause handing out subtasks of a handle
+	// - Form: handle
+	// - Return: okay / error
+	admin.With(ParseHandle(false)).Post("/dispatcher/pause", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		h.disp.Pause(GetHandleName(ctx))
+		WriteJSON(w, http.StatusOK, OK)
+	})
+
+	// Resume a paused handle
+	// ...
+	admin.With(ParseHandle(false)).Post("/dispatcher/resume", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		h.disp.Resume(GetHandleName(ctx))
+		WriteJSON(w, http.StatusOK, OK)
+	})
+
+	// Fail all queued subtasks of a handle
+	// - Form: handle
+	// - Return: drained / error
+	admin.With(ParseHandle(false)).Post("/dispatcher/drain", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		n := h.disp.Drain(GetHandleName(ctx))
+		WriteJSON(w, http.StatusOK, M{
+			"drained": n,
+		})
+	})
+
+	// Circuit breakers of handles
+	// - Return: []BreakerStatus
+	admin.Post("/dispatcher/breakers", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.Breakers())
+	})
+
+	// Satellites quarantined now
+	// - Return: []QuarantineStatus
+	admin.Post("/dispatcher/quarantines", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.Quarantines())
+	})
+
+	// Recent crashes of workers, with credentials redacted, and crashes of each satellite
+	// - Form: handle (optional)
+	// - Return: {crashes: []CrashStatus, counts: []CrashCount}
+	admin.With(ParseHandle(true)).Post("/dispatcher/crashes", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, M{
+			"crashes": h.disp.Crashes(GetHandleName(ctx)),
+			"counts":  h.disp.CrashCounts(),
+		})
+	})
+
+	// Config profiles of satellites
+	// - Return: ConfigProfiles
+	admin.Post("/dispatcher/satellite_config", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.ConfigProfiles())
+	})
+
+	// Replace config profiles of satellites, which get them as they poll
+	// - Form: profiles (ConfigProfiles)
+	// - Return: okay / error
+	admin.Post("/dispatcher/satellite_config/set", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var profiles dispatcher.ConfigProfiles
+		err := GetJSONKeyAs(ctx, "profiles", &profiles)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, BadField("profiles"))
+			return
+		}
+		err = h.disp.SetConfigProfiles(profiles)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, BadField("profiles"))
+			return
+		}
+		WriteJSON(w, http.StatusOK, OK)
+	})
+
+	// Config versions satellites run, and those they should run
+	// - Return: []SatelliteConfigStatus
+	admin.Post("/dispatcher/satellite_config/satellites", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.SatelliteConfigs())
+	})
+
+	// Quarantine a satellite for a handle by hand
+	// - Form: handle, satellite, duration (in seconds)
+	// - Return: okay / error
+	admin.With(ParseHandle(false)).Post("/dispatcher/quarantine", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var satellite string
+		err := GetJSONKeyAs(ctx, "satellite", &satellite)
+		if err != nil || satellite == "" {
+			WriteJSON(w, http.StatusBadRequest, BadField("satellite"))
+			return
+		}
+		var duration int
+		err = GetJSONKeyAs(ctx, "duration", &duration)
+		if err != nil || duration <= 0 {
+			WriteJSON(w, http.StatusBadRequest, BadField("duration"))
+			return
+		}
+		h.disp.Quarantine(satellite, GetHandleName(ctx), time.Duration(duration)*time.Second)
+		WriteJSON(w, http.StatusOK, OK)
+	})
+
+	// Release a satellite from quarantine for a handle
+	// - Form: handle, satellite
+	// - Return: okay / error
+	admin.With(ParseHandle(false)).Post("/dispatcher/release", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var satellite string
+		err := GetJSONKeyAs(ctx, "satellite", &satellite)
+		if err != nil || satellite == "" {
+			WriteJSON(w, http.StatusBadRequest, BadField("satellite"))
+			return
+		}
+		if !h.disp.Release(satellite, GetHandleName(ctx)) {
+			WriteJSON(w, http.StatusNotFound, NotFound)
+			return
+		}
+		WriteJSON(w, http.StatusOK, OK)
+	})
+
+	// Faults injected
+	// - Return: []FaultStatus
+	admin.Post("/dispatcher/faults", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.Faults())
+	})
+
+	// Inject faults into a handle, or into all handles without faults of their own if handle is "*"
+	// - Form: handle, faults (FaultStatus without handler)
+	// - Return: okay / error
+	admin.With(ParseFaultHandle).Post("/dispatcher/faults/set", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var f server.Faults
+		err := GetJSONKeyAs(ctx, "faults", &f)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, BadField("faults"))
+			return
+		}
+		h.disp.SetFaults(GetHandleName(ctx), f)
+		WriteJSON(w, http.StatusOK, OK)
+	})
+
+	// Stop injecting faults into a handle
+	// - Form: handle
+	// - Return: okay / error
+	admin.With(ParseFaultHandle).Post("/dispatcher/faults/clear", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		h.disp.ClearFaults(GetHandleName(ctx))
+		WriteJSON(w, http.StatusOK, OK)
+	})
+
+	// Private keys active on the dispatcher
+	// - Return: []KeyStatus
+	admin.Post("/dispatcher/keys", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.Keys())
+	})
+
+	// Load one more private key, e.g. when rolling out a new key pair
+	// - Form: path (on the server)
+	// - Return: key ID / error
+	admin.Post("/dispatcher/keys/load", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var path string
+		err := GetJSONKeyAs(ctx, "path", &path)
+		if err != nil || path == "" {
+			WriteJSON(w, http.StatusBadRequest, BadField("path"))
+			return
+		}
+		id, err := h.disp.LoadPrivKey(path)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, BadField("path"))
+			return
+		}
+		WriteJSON(w, http.StatusOK, id)
+	})
+
+	// Retire a private key no satellite uses any more
+	// - Form: key_id
+	// - Return: okay / error
+	admin.Post("/dispatcher/keys/retire", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var id string
+		err := GetJSONKeyAs(ctx, "key_id", &id)
+		if err != nil || id == "" {
+			WriteJSON(w, http.StatusBadRequest, BadField("key_id"))
+			return
+		}
+		switch h.disp.RetirePrivKey(id) {
+		case nil:
+			WriteJSON(w, http.StatusOK, OK)
+		case server.ErrUnknownKey:
+			WriteJSON(w, http.StatusNotFound, NotFound)
+		default:
+			WriteJSON(w, http.StatusBadRequest, BadField("key_id"))
+		}
+	})
+
+	// List satellites refused some operation
+	// - Return: []RefusedSatellite
+	admin.Post("/dispatcher/refused", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, h.disp.RefusedSatellites())
+	})
+
+	// Counters of the dispatcher, see `server.Dispatcher.MetricsName`
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/", amaterasu.Handler())
+	h.handler = mux
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r)
 }
@@ -8,6 +8,20 @@ import (
 var (
 	MaxRetry     int           = 5
 	LoopInterval time.Duration = 5 * time.Second
+
+	// How long to wait before the next attempt when the handler is paused by the dispatcher,
+	// its circuit breaker is open, or its queue is full.
+	BackOffInterval time.Duration = 30 * time.Second
+
+	// First attempts of tasks are spread over this period, so that tasks
+	// started together, e.g. on server start, do not attempt on the same tick.
+	StartSpread time.Duration = 5 * time.Second
+
+	// Size of the worker pool running task attempts. See `Scheduler`.
+	Workers int = 64
+
+	// How many subtasks all tasks could submit to the dispatcher at the same time.
+	MaxSubmissions int = 256
 )
 
 var (
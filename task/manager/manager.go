@@ -6,6 +6,7 @@ import (
 
 	"github.com/applepi-icpc/icarus"
 	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/dispatcher"
 	"github.com/applepi-icpc/icarus/task"
 	"github.com/applepi-icpc/icarus/task/storage"
 )
@@ -15,32 +16,33 @@ type TaskEntry struct {
 	Instance *task.Task
 }
 
-var mu sync.Mutex
-var tasks map[int]TaskEntry
+// Manager keeps tasks whose subtasks go to one dispatcher.
+// Each dispatcher has a manager of its own, so that several could coexist.
+type Manager struct {
+	mu    sync.Mutex
+	tasks map[int]TaskEntry
+	disp  client.Dispatcher
+}
 
 var (
 	ErrNotFound = errors.New("task ID not found")
 )
 
-func init() {
-	tasks = make(map[int]TaskEntry)
-}
-
 // this function only generate a task and add it into `tasks`
-func addTask(taskdata icarus.TaskData) (t *task.Task, err error) {
+func (m *Manager) addTask(taskdata icarus.TaskData) (t *task.Task, err error) {
 	c, err := client.GetHandle(taskdata.Handle)
 	if err != nil {
 		return
 	}
 	var user icarus.User
-	user, err = client.MakeUserByData(c, taskdata.User)
+	user, err = client.MakeUserByData(c, m.disp, taskdata.User)
 	if err != nil {
 		return
 	}
 	courses := make([]icarus.Course, 0)
 	for _, csData := range taskdata.Courses {
 		var cs icarus.Course
-		cs, err = client.MakeCourceByData(c, csData)
+		cs, err = client.MakeCourceByData(c, m.disp, csData)
 		if err != nil {
 			return
 		}
@@ -48,7 +50,8 @@ func addTask(taskdata icarus.TaskData) (t *task.Task, err error) {
 	}
 
 	t = task.NewTask(user, courses)
-	tasks[taskdata.ID] = TaskEntry{
+	t.SetTags(dispatcher.TaskTag(taskdata.ID))
+	m.tasks[taskdata.ID] = TaskEntry{
 		Header:   taskdata,
 		Instance: t,
 	}
@@ -56,9 +59,9 @@ func addTask(taskdata icarus.TaskData) (t *task.Task, err error) {
 	return
 }
 
-func CreateTask(taskdata icarus.TaskData) (ID int, t *task.Task, err error) {
-	mu.Lock()
-	defer mu.Unlock()
+func (m *Manager) CreateTask(taskdata icarus.TaskData) (ID int, t *task.Task, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	ID, err = storage.CreateTask(taskdata)
 	if err != nil {
@@ -66,16 +69,16 @@ func CreateTask(taskdata icarus.TaskData) (ID int, t *task.Task, err error) {
 	}
 	taskdata.ID = ID
 
-	t, err = addTask(taskdata)
+	t, err = m.addTask(taskdata)
 	return
 }
 
 // Once a task is deleted, it would be stopped first.
-func DeleteTask(ID int) error {
-	mu.Lock()
-	defer mu.Unlock()
+func (m *Manager) DeleteTask(ID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	entry, exist := tasks[ID]
+	entry, exist := m.tasks[ID]
 	if !exist {
 		return ErrNotFound
 	}
@@ -84,49 +87,49 @@ func DeleteTask(ID int) error {
 		return err
 	}
 	entry.Instance.Stop()
-	delete(tasks, ID)
+	delete(m.tasks, ID)
 	return nil
 }
 
-func GetTask(ID int) (*task.Task, error) {
-	mu.Lock()
-	defer mu.Unlock()
+func (m *Manager) GetTask(ID int) (*task.Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	entry, exist := tasks[ID]
+	entry, exist := m.tasks[ID]
 	if !exist {
 		return nil, ErrNotFound
 	}
 	return entry.Instance, nil
 }
 
-func ListTasks() []*task.Task {
-	mu.Lock()
-	defer mu.Unlock()
+func (m *Manager) ListTasks() []*task.Task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	res := make([]*task.Task, 0)
-	for _, entry := range tasks {
+	for _, entry := range m.tasks {
 		res = append(res, entry.Instance)
 	}
 	return res
 }
 
-func GetTaskData(ID int) (icarus.TaskData, error) {
-	mu.Lock()
-	defer mu.Unlock()
+func (m *Manager) GetTaskData(ID int) (icarus.TaskData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	entry, exist := tasks[ID]
+	entry, exist := m.tasks[ID]
 	if !exist {
 		return icarus.TaskData{}, ErrNotFound
 	}
 	return entry.Header, nil
 }
 
-func ListTasksData() []icarus.TaskData {
-	mu.Lock()
-	defer mu.Unlock()
+func (m *Manager) ListTasksData() []icarus.TaskData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	res := make([]icarus.TaskData, 0)
-	for _, entry := range tasks {
+	for _, entry := range m.tasks {
 		hdr := entry.Header
 		hdr.Stat = entry.Instance.Statistics()
 		res = append(res, hdr)
@@ -134,14 +137,20 @@ func ListTasksData() []icarus.TaskData {
 	return res
 }
 
+// Make a manager, restoring tasks stored, whose subtasks go to d.
 // This function will panic on any error it encounters.
-func InitManager() {
+func NewManager(d client.Dispatcher) *Manager {
+	m := &Manager{
+		tasks: make(map[int]TaskEntry),
+		disp:  d,
+	}
+
 	tasksdata, err := storage.ListTasks()
 	if err != nil {
 		panic(err)
 	}
 	for _, t := range tasksdata {
-		inst, err := addTask(t)
+		inst, err := m.addTask(t)
 
 		// Start task
 		inst.Start()
@@ -150,4 +159,5 @@ func InitManager() {
 			panic(err)
 		}
 	}
+	return m
 }
@@ -0,0 +1,189 @@
+package task
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Scheduler runs jobs at given times on a fixed pool of workers.
+//
+// All tasks share one scheduler (see `getScheduler`), instead of each sleeping in its own
+// goroutine, so thousands of tasks cost a heap entry each rather than a goroutine each.
+// It also caps how many subtasks are submitted to the dispatcher at the same time.
+// Submissions run in the background, so workers never wait for satellites.
+type Scheduler struct {
+	mu      sync.Mutex
+	entries entryHeap
+	wake    chan struct{}
+	jobs    chan func()
+	quit    chan struct{}
+	stop    sync.Once
+
+	smu         sync.Mutex
+	limit       int
+	submissions int      // Dispatcher submissions in progress
+	waiting     []func() // Submissions waiting for one in progress to finish
+}
+
+type entry struct {
+	at time.Time
+	f  func()
+}
+
+type entryHeap []*entry
+
+func (h entryHeap) Len() int            { return len(h) }
+func (h entryHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h entryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(*entry)) }
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// Make a scheduler with `workers` workers, allowing `submissions` dispatcher submissions at the same time.
+func NewScheduler(workers int, submissions int) *Scheduler {
+	s := &Scheduler{
+		entries: make(entryHeap, 0),
+		wake:    make(chan struct{}, 1),
+		jobs:    make(chan func()),
+		quit:    make(chan struct{}),
+		limit:   submissions,
+	}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	go s.loop()
+	return s
+}
+
+// Run f on a worker after d.
+func (s *Scheduler) After(d time.Duration, f func()) {
+	s.mu.Lock()
+	heap.Push(&s.entries, &entry{
+		at: time.Now().Add(d),
+		f:  f,
+	})
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Jobs scheduled and not run yet.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.entries)
+}
+
+// Stop the scheduler. Jobs not run yet are dropped, submissions are not.
+// This function could be called any times you want.
+func (s *Scheduler) Stop() {
+	s.stop.Do(func() {
+		close(s.quit)
+	})
+}
+
+// Call f as a dispatcher submission in the background, and return at once.
+// If too many are in progress, f waits in line until one of them finishes.
+// Whatever should follow f, e.g. the next attempt, is up to f to schedule.
+func (s *Scheduler) Submit(f func()) {
+	s.smu.Lock()
+	if s.submissions >= s.limit {
+		s.waiting = append(s.waiting, f)
+		s.smu.Unlock()
+		return
+	}
+	s.submissions++
+	s.smu.Unlock()
+
+	go s.submit(f)
+}
+
+// Run f, then submissions waiting in line, until there is none.
+func (s *Scheduler) submit(f func()) {
+	for f != nil {
+		f()
+
+		s.smu.Lock()
+		f = nil
+		if len(s.waiting) > 0 {
+			f = s.waiting[0]
+			s.waiting[0] = nil
+			s.waiting = s.waiting[1:]
+		} else {
+			s.submissions--
+		}
+		s.smu.Unlock()
+	}
+}
+
+func (s *Scheduler) work() {
+	for {
+		select {
+		case f := <-s.jobs:
+			f()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) loop() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		// Hand out jobs due. Blocks while all workers are busy.
+		s.mu.Lock()
+		for len(s.entries) > 0 && !s.entries[0].at.After(time.Now()) {
+			e := heap.Pop(&s.entries).(*entry)
+			s.mu.Unlock()
+			select {
+			case s.jobs <- e.f:
+			case <-s.quit:
+				return
+			}
+			s.mu.Lock()
+		}
+		wait := time.Hour
+		if len(s.entries) > 0 {
+			wait = s.entries[0].at.Sub(time.Now())
+		}
+		s.mu.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-s.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+var (
+	schedulerOnce sync.Once
+	scheduler     *Scheduler
+)
+
+// The scheduler shared by all tasks.
+// This function could be called any times you want.
+func getScheduler() *Scheduler {
+	schedulerOnce.Do(func() {
+		scheduler = NewScheduler(Workers, MaxSubmissions)
+	})
+	return scheduler
+}
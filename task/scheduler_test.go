@@ -0,0 +1,146 @@
+package task
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerOrder(t *testing.T) {
+	s := NewScheduler(1, 1)
+	defer s.Stop()
+
+	var mu sync.Mutex
+	order := make([]int, 0)
+	var wg sync.WaitGroup
+	for _, v := range []int{3, 1, 2} {
+		wg.Add(1)
+		v := v
+		s.After(time.Duration(v)*50*time.Millisecond, func() {
+			defer wg.Done()
+			mu.Lock()
+			order = append(order, v)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	if order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Fatalf("Wrong order: %v", order)
+	}
+}
+
+func TestSchedulerSubmissions(t *testing.T) {
+	s := NewScheduler(16, 2)
+	defer s.Stop()
+
+	var conc, maxConc int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		s.After(0, func() {
+			s.Submit(func() {
+				defer wg.Done()
+				c := atomic.AddInt32(&conc, 1)
+				defer atomic.AddInt32(&conc, -1)
+				for {
+					m := atomic.LoadInt32(&maxConc)
+					if c <= m || atomic.CompareAndSwapInt32(&maxConc, m, c) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+			})
+		})
+	}
+	wg.Wait()
+	if maxConc > 2 {
+		t.Fatalf("%d submissions at the same time", maxConc)
+	}
+}
+
+func TestSchedulerNotBlocked(t *testing.T) {
+	s := NewScheduler(1, 1)
+	defer s.Stop()
+
+	// Submissions waiting for satellites hold neither the worker nor each other's callers.
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < 3; i++ {
+		s.After(0, func() {
+			s.Submit(func() {
+				<-release
+			})
+		})
+	}
+
+	done := make(chan struct{})
+	s.After(10*time.Millisecond, func() {
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Worker blocked by submissions in progress")
+	}
+}
+
+// Attempts per second, when all of them are due at once.
+func BenchmarkSchedulerAttempts(b *testing.B) {
+	s := NewScheduler(Workers, MaxSubmissions)
+	defer s.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		s.After(0, func() {
+			s.Submit(wg.Done)
+		})
+	}
+	wg.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "attempts/s")
+}
+
+// How late attempts run, with thousands of tasks attempting every 100ms.
+func BenchmarkSchedulerJitter(b *testing.B) {
+	const tasks = 2000
+	const interval = 100 * time.Millisecond
+
+	s := NewScheduler(Workers, MaxSubmissions)
+	defer s.Stop()
+
+	var mu sync.Mutex
+	var total, worst time.Duration
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	left := int64(b.N)
+
+	var run func(due time.Time)
+	run = func(due time.Time) {
+		late := time.Since(due)
+		mu.Lock()
+		total += late
+		if late > worst {
+			worst = late
+		}
+		mu.Unlock()
+		wg.Done()
+		if atomic.AddInt64(&left, -1) >= tasks {
+			next := time.Now().Add(interval)
+			s.After(interval, func() { run(next) })
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < tasks && i < b.N; i++ {
+		// Spread like `StartSpread` does.
+		d := interval * time.Duration(i) / tasks
+		due := time.Now().Add(d)
+		s.After(d, func() { run(due) })
+	}
+	wg.Wait()
+	b.ReportMetric(float64(total.Microseconds())/float64(b.N), "jitter-us/op")
+	b.ReportMetric(float64(worst.Microseconds()), "max-jitter-us")
+}
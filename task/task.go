@@ -1,13 +1,16 @@
 package task
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/applepi-icpc/icarus"
+	"github.com/applepi-icpc/icarus/client"
+	"github.com/applepi-icpc/icarus/dispatcher"
+	"github.com/applepi-icpc/icarus/trace"
 )
 
 type Task struct {
@@ -16,7 +19,11 @@ type Task struct {
 
 	mutex        sync.Mutex
 	running      bool
-	currentRunID int32
+	currentRunID int32 // Changes at every start and every new login, so jobs of old ones stop.
+	retried      int
+	tags         []string
+	ctx          context.Context
+	cancel       context.CancelFunc // Cancels subtasks of the current run.
 
 	login   bool
 	session icarus.LoginSession
@@ -35,6 +42,14 @@ func NewTask(user icarus.User, courses []icarus.Course) *Task {
 	}
 }
 
+// Tag subtasks of this task, so they could be cancelled together.
+func (t *Task) SetTags(tags ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.tags = tags
+}
+
 // Get this task's login user.
 func (t *Task) User() icarus.User {
 	return t.user
@@ -45,15 +60,19 @@ func (t *Task) Courses() []icarus.Course {
 	return t.courses
 }
 
-func (t *Task) logError(err error, msg string) {
+func (t *Task) logError(ctx context.Context, err error, msg string) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	log.Warnf("%s: %s", msg, err.Error())
+	trace.Logger(ctx).Warnf("%s: %s", msg, err.Error())
 	t.failed++
 	t.lastError = err.Error()
 }
 
+func (t *Task) logPaused(ctx context.Context) {
+	trace.Logger(ctx).Infof("Handler paused, failing or overloaded, backing off")
+}
+
 func (t *Task) logOK() {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
@@ -68,83 +87,155 @@ func (t *Task) logElected() {
 	t.elected = true
 }
 
-func (t *Task) runOnce() bool {
-	if !t.login {
-		session, err := t.user.Login()
+// Log in, as a job of the scheduler. Once logged in, every course elects in jobs of its own,
+// see `elect`.
+func (t *Task) attempt(runID int32) {
+	ctx, _, ok := t.current(runID)
+	if !ok {
+		return
+	}
+
+	// Every attempt starts a new trace.
+	span, ctx := trace.Start(ctx, "task.attempt")
+	span.SetTag("user", t.user.Name())
+	span.SetTag("action", "login")
+
+	getScheduler().Submit(func() {
+		defer span.Finish()
+
+		session, err := t.user.Login(ctx)
 		if err != nil {
-			t.logError(err, fmt.Sprintf("%s", t.user.Name()))
-			return false
+			span.SetError(err)
 		}
-		t.login = true
-		t.session = session
-		return true
-	} else {
-		var wg sync.WaitGroup
-		noError := true
-		for _, v := range t.courses {
-			wg.Add(1)
-
-			// Elect a course
-			go func(c icarus.Course) {
-				defer wg.Done()
-				elected, err := c.Elect(t.session)
-				if err != nil {
-					noError = false
-					t.logError(err, fmt.Sprintf("%s: %s", t.user.Name(), c.Name()))
-
-					if err == ErrSessionExpired {
-						t.Restart()
-					}
-
-					return
-				}
-
-				t.logOK()
-
-				if elected {
-					t.logElected()
-					t.Stop()
-				}
-			}(v)
+		t.afterLogin(ctx, runID, session, err)
+	})
+}
+
+func (t *Task) afterLogin(ctx context.Context, runID int32, session icarus.LoginSession, err error) {
+	interval := LoopInterval
+	if err != nil {
+		if ctx.Err() != nil {
+			// This task has been stopped.
+			return
 		}
-		wg.Wait()
-		if t.elected {
-			return true
+		if client.IsBackOff(err) {
+			t.logPaused(ctx)
+			interval = BackOffInterval
 		} else {
-			return noError
+			t.logError(ctx, err, fmt.Sprintf("%s", t.user.Name()))
 		}
 	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.running || runID != t.currentRunID {
+		return
+	}
+	if err != nil {
+		getScheduler().After(interval, func() {
+			t.attempt(runID)
+		})
+		return
+	}
+
+	t.login = true
+	t.session = session
+	t.retried = 0
+	for _, v := range t.courses {
+		c := v
+		getScheduler().After(interval, func() {
+			t.elect(runID, c)
+		})
+	}
 }
 
-func (t *Task) run(runID int32) {
-	retried := 0
-	for t.running && runID == atomic.LoadInt32(&t.currentRunID) {
-		// endOfTurn := time.After(LoopInterval)
+// Elect course c once, as a job of the scheduler.
+// When done, c schedules its next election itself, so courses go at their own pace.
+func (t *Task) elect(runID int32, c icarus.Course) {
+	ctx, session, ok := t.current(runID)
+	if !ok {
+		return
+	}
+
+	// Every attempt starts a new trace.
+	span, ctx := trace.Start(ctx, "task.attempt")
+	span.SetTag("user", t.user.Name())
+	span.SetTag("action", "elect")
+	span.SetTag("course", c.Name())
 
-		// Do major work
-		ok := t.runOnce()
+	getScheduler().Submit(func() {
+		defer span.Finish()
 
-		func() {
-			t.mutex.Lock()
-			defer t.mutex.Unlock()
+		elected, err := c.Elect(ctx, session)
+		if err != nil {
+			span.SetError(err)
+		}
+		t.afterElect(ctx, runID, c, elected, err)
+	})
+}
 
-			if !ok {
-				retried++
-				if retried >= MaxRetry {
-					// Restart
-					t.login = false
-				}
-			} else {
-				retried = 0
-			}
-		}()
+func (t *Task) afterElect(ctx context.Context, runID int32, c icarus.Course, elected bool, err error) {
+	interval := LoopInterval
+	failed := false
+	if err != nil {
+		if ctx.Err() != nil {
+			// This task has been stopped.
+			return
+		}
+		if client.IsBackOff(err) {
+			t.logPaused(ctx)
+			interval = BackOffInterval
+		} else {
+			failed = true
+			t.logError(ctx, err, fmt.Sprintf("%s: %s", t.user.Name(), c.Name()))
+		}
+	} else {
+		t.logOK()
+		if elected {
+			t.logElected()
+			t.Stop()
+			return
+		}
+	}
 
-		// This way will cause a interval too short and crush a query.
-		// <-endOfTurn
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
-		// A more naive way.
-		time.Sleep(LoopInterval)
+	if !t.running || runID != t.currentRunID {
+		return
+	}
+	if failed {
+		t.retried++
+		if err == ErrSessionExpired || t.retried >= MaxRetry {
+			t.reloginLocked()
+			return
+		}
+	} else {
+		t.retried = 0
 	}
+	getScheduler().After(interval, func() {
+		t.elect(runID, c)
+	})
+}
+
+// The context and the session of the run, and whether runID is still the current one.
+func (t *Task) current(runID int32) (context.Context, icarus.LoginSession, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.ctx, t.session, t.running && runID == t.currentRunID
+}
+
+// Drop the session and log in again. Elections of the old session stop, as the run ID changes.
+func (t *Task) reloginLocked() {
+	t.login = false
+	t.retried = 0
+	t.currentRunID++
+	runID := t.currentRunID
+	getScheduler().After(LoopInterval, func() {
+		t.attempt(runID)
+	})
 }
 
 // Start this task.
@@ -157,8 +248,19 @@ func (t *Task) Start() {
 		t.login = false
 		t.elected = false
 
+		// Subtasks still running when this task stops are cancelled.
+		t.ctx, t.cancel = context.WithCancel(dispatcher.WithTags(context.Background(), t.tags...))
+
 		t.currentRunID++
-		go t.run(t.currentRunID)
+		t.retried = 0
+		var spread time.Duration
+		if StartSpread > 0 {
+			spread = time.Duration(rand.Int63n(int64(StartSpread)))
+		}
+		runID := t.currentRunID
+		getScheduler().After(spread, func() {
+			t.attempt(runID)
+		})
 	}
 }
 
@@ -169,6 +271,9 @@ func (t *Task) Stop() {
 
 	t.running = false
 	t.login = false
+	if t.cancel != nil {
+		t.cancel()
+	}
 }
 
 // Restart this task.
@@ -176,8 +281,8 @@ func (t *Task) Restart() {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	if t.running {
-		t.login = false
+	if t.running && t.login {
+		t.reloginLocked()
 	}
 }
 
@@ -1,6 +1,7 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"log"
 	"math/rand"
@@ -36,7 +37,7 @@ func (t *testCourse) Name() string {
 	return "Test Course"
 }
 
-func (t *testCourse) Elect(k icarus.LoginSession) (bool, error) {
+func (t *testCourse) Elect(ctx context.Context, k icarus.LoginSession) (bool, error) {
 	conc := atomic.AddInt32(&t.concurrent, 1)
 	if conc > 1 && t.noConcurrent {
 		log.Fatalf("2 goroutines electing at the same time!")
@@ -83,7 +84,7 @@ func (t *testUser) Name() string {
 	return "Test User"
 }
 
-func (t *testUser) Login() (icarus.LoginSession, error) {
+func (t *testUser) Login(ctx context.Context) (icarus.LoginSession, error) {
 	conc := atomic.AddInt32(&t.concurrent, 1)
 	if conc > 1 && t.noConcurrent {
 		log.Fatalf("2 goroutines electing at the same time!")
@@ -105,13 +106,14 @@ func (t *testUser) Login() (icarus.LoginSession, error) {
 	}
 }
 
-func (t *testUser) ListCourse() ([]icarus.CourseData, error) {
+func (t *testUser) ListCourse(ctx context.Context) ([]icarus.CourseData, error) {
 	return nil, nil
 }
 
 func TestBasic(t *testing.T) {
 	MaxRetry = 5
 	LoopInterval = 3 * time.Second
+	StartSpread = 0
 	log.Printf("TestBasic: Elect every %.2f seconds.", float32(LoopInterval/time.Second))
 
 	var testCount int32 = 5
@@ -148,6 +150,7 @@ func TestBasic(t *testing.T) {
 func TestStartStop(t *testing.T) {
 	MaxRetry = 5
 	LoopInterval = 3 * time.Second
+	StartSpread = 0
 	log.Printf("TestStartStop: Elect every %.2f seconds.", float32(LoopInterval/time.Second))
 
 	var testCount int32 = 5
@@ -191,6 +194,7 @@ func TestStartStop(t *testing.T) {
 func TestRestart(t *testing.T) {
 	MaxRetry = 5
 	LoopInterval = 3 * time.Second
+	StartSpread = 0
 	log.Printf("TestRestart: Elect every %.2f seconds.", float32(LoopInterval/time.Second))
 
 	var testCount int32 = 5
@@ -229,6 +233,7 @@ func TestRestart(t *testing.T) {
 func TestStop(t *testing.T) {
 	MaxRetry = 5
 	LoopInterval = 3 * time.Second
+	StartSpread = 0
 	log.Printf("TestStop: Elect every %.2f seconds.", float32(LoopInterval/time.Second))
 
 	var testCount int32 = 5
@@ -261,6 +266,7 @@ func TestStop(t *testing.T) {
 func TestStopWhenRestarting(t *testing.T) {
 	MaxRetry = 5
 	LoopInterval = 3 * time.Second
+	StartSpread = 0
 	log.Printf("TestStopWhenRestarting: Elect every %.2f seconds.", float32(LoopInterval/time.Second))
 
 	var testCount int32 = 5
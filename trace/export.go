@@ -0,0 +1,67 @@
+package trace
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	flagTraceFile = flag.String("trace", "", "Path of JSON-lines span export (empty to disable)")
+
+	exportOnce sync.Once
+	exportMu   sync.Mutex
+	exporter   *json.Encoder
+)
+
+// This function could be called any times you want, explicitly or implicitly.
+// Spans are appended to the file one JSON object per line.
+func InitExporter() {
+	exportOnce.Do(func() {
+		if *flagTraceFile == "" {
+			return
+		}
+		f, err := os.OpenFile(*flagTraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Errorf("Trace: failed to open %s: %s", *flagTraceFile, err.Error())
+			return
+		}
+		exporter = json.NewEncoder(f)
+	})
+}
+
+// Export spans to w instead of the file given by `-trace`.
+// Pass nil to disable exporting.
+func SetExporter(w io.Writer) {
+	InitExporter()
+
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	if w == nil {
+		exporter = nil
+	} else {
+		exporter = json.NewEncoder(w)
+	}
+}
+
+func export(s *Span) {
+	InitExporter()
+
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	if exporter == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := exporter.Encode(s)
+	if err != nil {
+		log.Warnf("Trace: failed to export span %s: %s", s.SpanID, err.Error())
+	}
+}
@@ -0,0 +1,165 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SpanContext is the part of a span that travels with a subtask,
+// so the other side could continue the same trace.
+type SpanContext struct {
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
+}
+
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// A span is a timed piece of work in a trace.
+// A trace starts at a task attempt and ends at the result sent back by a satellite.
+type Span struct {
+	TraceID  string            `json:"trace_id"`
+	SpanID   string            `json:"span_id"`
+	ParentID string            `json:"parent_id,omitempty"`
+	Name     string            `json:"name"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Error    string            `json:"error,omitempty"`
+
+	mu       sync.Mutex
+	finished bool
+}
+
+const (
+	traceIDLength = 16
+	spanIDLength  = 8
+)
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Start a span whose parent comes from the other side.
+// If parent is not valid, a new trace begins.
+func StartFrom(parent SpanContext, name string) *Span {
+	s := &Span{
+		SpanID: randomID(spanIDLength),
+		Name:   name,
+		Start:  time.Now(),
+	}
+	if parent.Valid() {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = randomID(traceIDLength)
+	}
+	return s
+}
+
+// Start a span as a child of the span carried by ctx (if any),
+// and return a context carrying the new span.
+func Start(ctx context.Context, name string) (*Span, context.Context) {
+	s := StartFrom(FromContext(ctx).Context(), name)
+	return s, NewContext(ctx, s)
+}
+
+// Context of a nil span is an invalid (empty) one.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{
+		TraceID: s.TraceID,
+		SpanID:  s.SpanID,
+	}
+}
+
+func (s *Span) SetTag(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Tags == nil {
+		s.Tags = make(map[string]string)
+	}
+	s.Tags[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Error = err.Error()
+}
+
+// Finish this span and export it. Only the first call takes effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	export(s)
+}
+
+// Fields to stamp log lines with.
+func (s *Span) Fields() log.Fields {
+	if s == nil {
+		return log.Fields{}
+	}
+	return log.Fields{
+		"trace_id": s.TraceID,
+		"span_id":  s.SpanID,
+	}
+}
+
+// Logger stamped with the span.
+func (s *Span) Logger() *log.Entry {
+	return log.WithFields(s.Fields())
+}
+
+type keyType int
+
+const keySpan keyType = iota
+
+func NewContext(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, keySpan, s)
+}
+
+// Returns nil if there is no span in ctx.
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(keySpan).(*Span)
+	return s
+}
+
+// Logger stamped with the span carried by ctx.
+func Logger(ctx context.Context) *log.Entry {
+	return FromContext(ctx).Logger()
+}
@@ -0,0 +1,62 @@
+package trace_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/applepi-icpc/icarus/trace"
+)
+
+func TestSpanTree(t *testing.T) {
+	var buf bytes.Buffer
+	trace.SetExporter(&buf)
+	defer trace.SetExporter(nil)
+
+	root, ctx := trace.Start(context.Background(), "task.attempt")
+	child, _ := trace.Start(ctx, "task.elect")
+	remote := trace.StartFrom(child.Context(), "satellite.subtask")
+
+	if child.TraceID != root.TraceID || remote.TraceID != root.TraceID {
+		t.Fatalf("Trace ID is not propagated.")
+	}
+	if child.ParentID != root.SpanID || remote.ParentID != child.SpanID {
+		t.Fatalf("Wrong parent span.")
+	}
+
+	remote.SetError(errors.New("full"))
+	remote.Finish()
+	remote.Finish()
+	child.Finish()
+	root.Finish()
+
+	dec := json.NewDecoder(&buf)
+	names := make([]string, 0)
+	for dec.More() {
+		var s trace.Span
+		if err := dec.Decode(&s); err != nil {
+			t.Fatalf("Error decoding exported span: %s", err.Error())
+		}
+		if s.TraceID != root.TraceID {
+			t.Fatalf("Exported span has wrong trace ID: %s", s.TraceID)
+		}
+		names = append(names, s.Name)
+	}
+	if len(names) != 3 {
+		t.Fatalf("Exported %d span(s): %v", len(names), names)
+	}
+}
+
+func TestNilSpan(t *testing.T) {
+	s := trace.FromContext(context.Background())
+	if s != nil {
+		t.Fatalf("Got a span from an empty context.")
+	}
+	if s.Context().Valid() {
+		t.Fatalf("Context of nil span should not be valid.")
+	}
+	s.SetTag("k", "v")
+	s.Finish()
+}
@@ -1,14 +1,20 @@
 package icarus
 
+import "context"
+
 type LoginSession interface{}
+
+// The context passed to Elect carries the trace of the current attempt.
 type Course interface {
 	Name() string
-	Elect(LoginSession) (bool, error)
+	Elect(context.Context, LoginSession) (bool, error)
 }
+
+// Contexts passed to Login and ListCourse carry the trace of the current attempt.
 type User interface {
 	Name() string
-	Login() (LoginSession, error)
-	ListCourse() ([]CourseData, error)
+	Login(context.Context) (LoginSession, error)
+	ListCourse(context.Context) ([]CourseData, error)
 }
 
 type UserData struct {